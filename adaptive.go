@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+const heapCheckInterval = 250 * time.Millisecond
+
+// windowLimits limits the size of a window in time mode. Windows exceeding
+// one of the limits are converted again with half the width. A zero value
+// disables the limit.
+type windowLimits struct {
+	minWidth     int64
+	maxSeries    int
+	maxSamples   int64
+	memoryBudget uint64
+}
+
+// enabled returns true if any limit is set.
+func (l windowLimits) enabled() bool {
+	return l.maxSeries > 0 || l.maxSamples > 0 || l.memoryBudget > 0
+}
+
+// canHalve returns true if a window of the width can be converted again with
+// half the width. Halving an even width which divides the step keeps it a
+// divisor of the step, so the halved windows stay aligned to the step.
+func (l windowLimits) canHalve(width int64) bool {
+	return l.enabled() && width%2 == 0 && width/2 >= l.minWidth
+}
+
+// sparse returns true if the window used less than half of every limit, so
+// that the next window can have twice the width.
+func (l windowLimits) sparse(stats rangeStats) bool {
+	return (l.maxSeries == 0 || stats.series <= int64(l.maxSeries)/2) &&
+		(l.maxSamples == 0 || stats.samples <= l.maxSamples/2) &&
+		(l.memoryBudget == 0 || stats.heap <= l.memoryBudget/2)
+}
+
+// windowTooLargeError is returned when a window exceeds one of the limits.
+type windowTooLargeError struct {
+	reason string
+}
+
+func (e windowTooLargeError) Error() string {
+	return fmt.Sprintf("window too large: %s", e.reason)
+}
+
+// heapMonitor periodically checks the heap size while a window is converted.
+type heapMonitor struct {
+	budget   uint64
+	peak     uint64
+	exceeded int32
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func startHeapMonitor(budget uint64) *heapMonitor {
+	m := &heapMonitor{
+		budget: budget,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go m.run()
+
+	return m
+}
+
+func (m *heapMonitor) run() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(heapCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		m.check()
+
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *heapMonitor) check() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	if stats.HeapAlloc > atomic.LoadUint64(&m.peak) {
+		atomic.StoreUint64(&m.peak, stats.HeapAlloc)
+	}
+
+	if stats.HeapAlloc > m.budget {
+		atomic.StoreInt32(&m.exceeded, 1)
+	}
+}
+
+// Exceeded returns true if the heap has been larger than the budget.
+func (m *heapMonitor) Exceeded() bool {
+	return atomic.LoadInt32(&m.exceeded) == 1
+}
+
+// Stop ends the monitoring and returns the largest heap size seen.
+func (m *heapMonitor) Stop() uint64 {
+	close(m.stop)
+	<-m.done
+	m.check()
+
+	return atomic.LoadUint64(&m.peak)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/tsdb"
+	cfg "github.com/xperimental/tsdb-migrate/config"
+)
+
+func TestCanHalve(t *testing.T) {
+	const hour = int64(time.Hour / time.Millisecond)
+	limits := windowLimits{minWidth: hour / 4, maxSeries: 1}
+
+	for _, test := range []struct {
+		limits windowLimits
+		width  int64
+		want   bool
+	}{
+		{limits: limits, width: 24 * hour, want: true},
+		{limits: limits, width: hour / 2, want: true},
+		{limits: limits, width: hour / 4, want: false},
+		// Halving an odd width would create windows which do not divide the step.
+		{limits: windowLimits{minWidth: 1, maxSeries: 1}, width: 3, want: false},
+		{limits: windowLimits{minWidth: 1, maxSeries: 1}, width: 6, want: true},
+		{limits: windowLimits{minWidth: 1}, width: 24 * hour, want: false},
+	} {
+		if got := test.limits.canHalve(test.width); got != test.want {
+			t.Errorf("%+v with width %d: got %t, want %t", test.limits, test.width, got, test.want)
+		}
+	}
+}
+
+// TestHalvedWindowsMerged checks that the blocks of halved windows are merged
+// into one block per step, so that Prometheus 2 can open the output.
+func TestHalvedWindowsMerged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsdb-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prometheus.DefaultRegisterer = prometheus.NewRegistry()
+
+	const minute = int64(60000)
+	input := testSeriesInput()
+	step := 2 * time.Hour
+	width := int64(step / time.Millisecond)
+	start, end := timeFromMillis(30*minute), timeFromMillis(550*minute+1)
+
+	ctx := context.Background()
+	matcherSets := []metric.LabelMatchers{{}}
+	metrics, err := listSeries(ctx, input, model.TimeFromUnixNano(start.UnixNano()), model.TimeFromUnixNano(end.UnixNano())-1, matcherSets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relabeler, err := newRelabeler(labelRules{}, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Windows with more than one series are halved down to 15 minutes.
+	limits := windowLimits{minWidth: 15 * minute, maxSeries: 1}
+	rep := newReport("", dir, cfg.ModeTime, start, end)
+	cp := newCheckpoint(dir, cfg.ModeTime, step, start, end, false)
+	if err := runConvert(ctx, input, cp, dir, start, end, step, matcherSets, relabeler, nil, nil, 1, limits, rep, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rep.windows) <= 5 {
+		t.Fatalf("got %d windows, want halved windows", len(rep.windows))
+	}
+
+	output := readTestOutput(t, dir)
+	want := [][2]int64{}
+	for mint := int64(0); mint < 550*minute+1; mint += width {
+		want = append(want, [2]int64{mint, mint + width})
+	}
+	if !reflect.DeepEqual(output.blocks, want) {
+		t.Errorf("got blocks %v, want %v", output.blocks, want)
+	}
+
+	interval := metric.Interval{
+		OldestInclusive: model.TimeFromUnixNano(start.UnixNano()),
+		NewestInclusive: model.TimeFromUnixNano(end.UnixNano()) - 1,
+	}
+	for _, s := range input {
+		lset := convertMetric(s.metric).String()
+		if samples := s.RangeValues(interval); !reflect.DeepEqual(output.samples[lset], samples) {
+			t.Errorf("%s: got %d samples, want %d", lset, len(output.samples[lset]), len(samples))
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, stagingDirName)); !os.IsNotExist(err) {
+		t.Errorf("staging directory not removed: %v", err)
+	}
+
+	db, err := tsdb.Open(dir, nil, nil, tsdb.DefaultOptions)
+	if err != nil {
+		t.Fatalf("error opening output: %s", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestResumeHalvedWindows checks that a resumed conversion removes the staged
+// blocks of a partly converted step and skips a step merged after the
+// checkpoint was saved.
+func TestResumeHalvedWindows(t *testing.T) {
+	const hour = int64(time.Hour / time.Millisecond)
+	step := 4 * time.Hour
+
+	for _, test := range []struct {
+		name   string
+		output [][2]int64
+		want   int64
+	}{
+		{
+			name:   "partly converted step",
+			output: [][2]int64{{0, 4 * hour}},
+			want:   4 * hour,
+		},
+		{
+			name:   "merged step",
+			output: [][2]int64{{0, 4 * hour}, {4 * hour, 8 * hour}},
+			want:   8 * hour,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "tsdb-migrate")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			for _, block := range test.output {
+				writeTestBlock(t, dir, block[0], block[1])
+			}
+			// The staged blocks of the halved windows cover the whole step.
+			staging := filepath.Join(dir, stagingDirName)
+			writeTestBlock(t, staging, 4*hour, 8*hour)
+			writeTestBlock(t, staging, 4*hour+1, 8*hour)
+
+			cp := newCheckpoint(dir, cfg.ModeTime, step, timeFromMillis(0), timeFromMillis(12*hour), false)
+			if err := cp.SaveWindow(timeFromMillis(4 * hour)); err != nil {
+				t.Fatal(err)
+			}
+
+			cp, err = loadCheckpoint(dir, cfg.ModeTime, step, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want := timeFromMillis(test.want); !cp.WindowEnd.Equal(want) {
+				t.Errorf("got window end %s, want %s", cp.WindowEnd, want)
+			}
+
+			staged, err := blockDirs(staging)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(staged) != 0 {
+				t.Errorf("got staged blocks %v, want none", staged)
+			}
+		})
+	}
+}
+
+func writeTestBlock(t *testing.T, dir string, mint, maxt int64) {
+	id := ulid.MustNew(ulid.Now(), rand.New(rand.NewSource(mint)))
+	b, err := json.Marshal(blockMeta{
+		Version: 1,
+		BlockMeta: &tsdb.BlockMeta{
+			ULID:    id,
+			MinTime: mint,
+			MaxTime: maxt,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blockDir := filepath.Join(dir, id.String())
+	if err := os.MkdirAll(blockDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(blockDir, "meta.json"), b, 0666); err != nil {
+		t.Fatal(err)
+	}
+}
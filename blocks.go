@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// blockInfo describes a block in the output directory.
+type blockInfo struct {
+	dir    string
+	meta   *tsdb.BlockMeta
+	series int
+	chunks int
+	size   int64
+}
+
+// runInspectBlocks writes a summary of the blocks in the output directory to
+// out. It returns an error if problems with the blocks have been found.
+func runInspectBlocks(dir string, retention time.Duration, out io.Writer) error {
+	dirs, err := blockDirs(dir)
+	if err != nil {
+		return fmt.Errorf("error listing blocks: %s", err)
+	}
+
+	var problems []string
+	blocks := make([]blockInfo, 0, len(dirs))
+	for _, d := range dirs {
+		b, err := readBlockInfo(d)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Block %s can not be read: %s", filepath.Base(d), err))
+			continue
+		}
+
+		if uint64(b.series) != b.meta.Stats.NumSeries || uint64(b.chunks) != b.meta.Stats.NumChunks {
+			problems = append(problems, fmt.Sprintf("Block %s has %d series and %d chunks in the index, but %d series and %d chunks in meta.json",
+				filepath.Base(b.dir), b.series, b.chunks, b.meta.Stats.NumSeries, b.meta.Stats.NumChunks))
+		}
+		blocks = append(blocks, b)
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].meta.MinTime < blocks[j].meta.MinTime })
+
+	for i := 1; i < len(blocks); i++ {
+		prev, b := blocks[i-1], blocks[i]
+		if b.meta.MinTime < prev.meta.MaxTime {
+			problems = append(problems, fmt.Sprintf("Block %s overlaps block %s", filepath.Base(b.dir), filepath.Base(prev.dir)))
+		}
+	}
+
+	// Prometheus 2 deletes blocks which end before the retention, counted
+	// back from the end of the newest block.
+	if len(blocks) > 0 {
+		newest := blocks[len(blocks)-1].meta.MaxTime
+		for _, b := range blocks {
+			if b.meta.MaxTime < newest-int64(retention/time.Millisecond) {
+				problems = append(problems, fmt.Sprintf("Block %s ends before the retention of %s", filepath.Base(b.dir), retention))
+			}
+		}
+	}
+
+	leftovers, err := leftoverFiles(dir)
+	if err != nil {
+		return fmt.Errorf("error checking for leftover files: %s", err)
+	}
+	for _, name := range leftovers {
+		problems = append(problems, fmt.Sprintf("Leftover %s", name))
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ULID\tMIN TIME\tMAX TIME\tLEVEL\tSERIES\tCHUNKS\tSAMPLES\tSIZE")
+	var series, chunks, samples uint64
+	var size int64
+	for _, b := range blocks {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\n", filepath.Base(b.dir),
+			timeFromMillis(b.meta.MinTime).Format(time.RFC3339), timeFromMillis(b.meta.MaxTime).Format(time.RFC3339),
+			b.meta.Compaction.Level, b.meta.Stats.NumSeries, b.meta.Stats.NumChunks, b.meta.Stats.NumSamples, b.size)
+
+		series += b.meta.Stats.NumSeries
+		chunks += b.meta.Stats.NumChunks
+		samples += b.meta.Stats.NumSamples
+		size += b.size
+	}
+	fmt.Fprintf(w, "%d blocks\t\t\t\t%d\t%d\t%d\t%d\n", len(blocks), series, chunks, samples, size)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(problems) > 0 {
+		fmt.Fprintln(out)
+		for _, p := range problems {
+			fmt.Fprintln(out, p)
+		}
+		return fmt.Errorf("found %d problems", len(problems))
+	}
+
+	return nil
+}
+
+// readBlockInfo reads the meta file of the block in dir and counts the series
+// and chunks in its index.
+func readBlockInfo(dir string) (blockInfo, error) {
+	b := blockInfo{dir: dir}
+
+	meta, err := readBlockMeta(dir)
+	if err != nil {
+		return b, fmt.Errorf("error reading meta: %s", err)
+	}
+	b.meta = meta
+
+	index, err := tsdb.NewIndexReader(dir)
+	if err != nil {
+		return b, fmt.Errorf("error opening index: %s", err)
+	}
+	defer index.Close()
+
+	err = forEachSeries(index, func(_ labels.Labels, chks []tsdb.ChunkMeta) error {
+		b.series++
+		b.chunks += len(chks)
+		return nil
+	})
+	if err != nil {
+		return b, err
+	}
+
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			b.size += fi.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return b, fmt.Errorf("error reading size: %s", err)
+	}
+
+	return b, nil
+}
+
+// leftoverFiles returns the files in the output directory which are not part
+// of a completed migration.
+func leftoverFiles(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, fi := range files {
+		name := fi.Name()
+		switch {
+		case name == "wal":
+			walFiles, err := ioutil.ReadDir(filepath.Join(dir, name))
+			if err != nil {
+				return nil, err
+			}
+			if len(walFiles) > 0 {
+				result = append(result, "write-ahead log: "+name)
+			}
+		case strings.HasSuffix(name, ".tmp"):
+			result = append(result, "incomplete block: "+name)
+		case name == stagingDirName:
+			result = append(result, "staging directory of series mode: "+name)
+		case name == checkpointFileName:
+			result = append(result, "checkpoint of an unfinished migration: "+name)
+		}
+	}
+
+	return result, nil
+}
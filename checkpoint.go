@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb"
+	cfg "github.com/xperimental/tsdb-migrate/config"
+)
+
+const checkpointFileName = "migrate-checkpoint.json"
+
+// checkpoint records the progress of a conversion in the output directory,
+// so that an interrupted conversion can be resumed.
+type checkpoint struct {
+	Mode string        `json:"mode"`
+	Step time.Duration `json:"step"`
+	// Start and End are the conversion range. A resumed conversion uses them
+	// instead of evaluating relative times again.
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// WindowEnd is the end of the last step written in time mode.
+	WindowEnd time.Time `json:"windowEnd,omitempty"`
+	// LastFingerprint is the last series which has been staged in series mode.
+	LastFingerprint string `json:"lastFingerprint,omitempty"`
+	// Staged contains the blocks in the staging directory which belong to
+	// the completed series. With a split output the names are prefixed with
+	// the output directory.
+	Staged []string `json:"staged,omitempty"`
+	// Split is set if the series are written to several output directories
+	// below the output directory.
+	Split bool `json:"split,omitempty"`
+	// DownsampleRef is the time the age of the samples is counted back from
+	// when downsampling. A resumed conversion uses it instead of the start of
+	// the run.
+	DownsampleRef time.Time `json:"downsampleRef,omitempty"`
+
+	dir string
+}
+
+func newCheckpoint(dir, mode string, step time.Duration, start, end time.Time, split bool) *checkpoint {
+	return &checkpoint{
+		Mode:  mode,
+		Step:  step,
+		Start: start,
+		End:   end,
+		Split: split,
+		dir:   dir,
+	}
+}
+
+// readCheckpoint reads the checkpoint from the output directory without
+// checking it.
+func readCheckpoint(dir string) (*checkpoint, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, checkpointFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	cp := &checkpoint{dir: dir}
+	if err := json.Unmarshal(b, cp); err != nil {
+		return nil, fmt.Errorf("error parsing checkpoint: %s", err)
+	}
+
+	return cp, nil
+}
+
+// loadCheckpoint reads the checkpoint from the output directory and removes
+// data written after it was saved.
+func loadCheckpoint(dir, mode string, step time.Duration, split bool) (*checkpoint, error) {
+	cp, err := readCheckpoint(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if cp.Mode != mode {
+		return nil, fmt.Errorf("checkpoint was created in %s mode", cp.Mode)
+	}
+
+	if cp.Step != step {
+		return nil, fmt.Errorf("checkpoint was created with step %s", cp.Step)
+	}
+
+	if cp.Split != split {
+		return nil, errors.New("checkpoint was created with a different output split")
+	}
+
+	if cp.Start.IsZero() || cp.End.IsZero() {
+		return nil, errors.New("checkpoint contains no time range")
+	}
+
+	outputs, err := outputDirs(dir, split)
+	if err != nil {
+		return nil, fmt.Errorf("error listing outputs: %s", err)
+	}
+
+	for _, output := range outputs {
+		if err := removeTemporaryBlocks(output); err != nil {
+			return nil, err
+		}
+	}
+
+	// Blocks of windows in time mode are only staged until their step is
+	// complete, so they are all removed.
+	for _, output := range outputs {
+		if err := cp.cleanStaging(output); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case mode == cfg.ModeSeries:
+	case split:
+		for _, output := range outputs {
+			if err := cp.removeWrittenWindows(output); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		if err := cp.skipWrittenWindows(); err != nil {
+			return nil, err
+		}
+	}
+
+	return cp, nil
+}
+
+// skipWrittenWindows moves the checkpoint behind blocks which have been
+// written after the checkpoint was last saved.
+func (c *checkpoint) skipWrittenWindows() error {
+	dirs, err := blockDirs(c.dir)
+	if err != nil {
+		return fmt.Errorf("error listing blocks: %s", err)
+	}
+
+	metas := make([]*tsdb.BlockMeta, 0, len(dirs))
+	for _, dir := range dirs {
+		meta, err := readBlockMeta(dir)
+		if err != nil {
+			return fmt.Errorf("error reading meta of %s: %s", dir, err)
+		}
+		metas = append(metas, meta)
+	}
+
+	// The first block covers the whole step containing the start.
+	end := c.written()
+	for skipped := true; skipped; {
+		skipped = false
+		for _, meta := range metas {
+			if meta.MinTime <= end && end < meta.MaxTime {
+				end = meta.MaxTime
+				skipped = true
+			}
+		}
+	}
+	if end != c.written() {
+		c.WindowEnd = timeFromMillis(end)
+	}
+
+	return nil
+}
+
+// removeWrittenWindows removes the blocks of output which have been written
+// after the checkpoint was last saved. With a split output, the window may
+// only have been written to some of the directories, so it is converted again.
+func (c *checkpoint) removeWrittenWindows(output string) error {
+	dirs, err := blockDirs(output)
+	if err != nil {
+		return fmt.Errorf("error listing blocks: %s", err)
+	}
+
+	end := c.written()
+	for _, dir := range dirs {
+		meta, err := readBlockMeta(dir)
+		if err != nil {
+			return fmt.Errorf("error reading meta of %s: %s", dir, err)
+		}
+
+		if meta.MaxTime <= end {
+			continue
+		}
+
+		log.Printf("Removing block written after the checkpoint: %s", dir)
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("error removing block: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// written returns the time up to which the windows have been written in time
+// mode.
+func (c *checkpoint) written() int64 {
+	if c.WindowEnd.IsZero() {
+		return c.Start.UnixNano() / 1e6
+	}
+	return c.WindowEnd.UnixNano() / 1e6
+}
+
+// cleanStaging removes the staged blocks which are not recorded in the
+// checkpoint. In series mode, these belong to series which have not been
+// completed.
+func (c *checkpoint) cleanStaging(output string) error {
+	staging := filepath.Join(output, stagingDirName)
+	if err := removeTemporaryBlocks(staging); err != nil {
+		return err
+	}
+
+	dirs, err := blockDirs(staging)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return fmt.Errorf("error listing staged blocks: %s", err)
+	}
+
+	staged := make(map[string]bool)
+	for _, id := range c.Staged {
+		staged[id] = true
+	}
+
+	for _, dir := range dirs {
+		if staged[c.stagedName(output, dir)] {
+			continue
+		}
+
+		log.Printf("Removing incomplete block: %s", dir)
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("error removing block: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// Fingerprint returns the last completed fingerprint in series mode.
+func (c *checkpoint) Fingerprint() (model.Fingerprint, bool) {
+	if c.LastFingerprint == "" {
+		return 0, false
+	}
+
+	fp, err := model.FingerprintFromString(c.LastFingerprint)
+	if err != nil {
+		return 0, false
+	}
+
+	return fp, true
+}
+
+// SaveWindow records that all windows up to end have been written.
+func (c *checkpoint) SaveWindow(end time.Time) error {
+	c.WindowEnd = end
+	return c.save()
+}
+
+// SaveSeries records that all series up to fp have been staged.
+func (c *checkpoint) SaveSeries(fp model.Fingerprint) error {
+	outputs, err := outputDirs(c.dir, c.Split)
+	if err != nil {
+		return fmt.Errorf("error listing outputs: %s", err)
+	}
+
+	c.Staged = c.Staged[:0]
+	for _, output := range outputs {
+		dirs, err := blockDirs(filepath.Join(output, stagingDirName))
+		switch {
+		case os.IsNotExist(err):
+			continue
+		case err != nil:
+			return fmt.Errorf("error listing staged blocks: %s", err)
+		}
+
+		for _, dir := range dirs {
+			c.Staged = append(c.Staged, c.stagedName(output, dir))
+		}
+	}
+	sort.Strings(c.Staged)
+
+	c.LastFingerprint = fp.String()
+	return c.save()
+}
+
+// stagedName returns the name of a staged block, which is prefixed with the
+// output directory relative to the checkpoint if the output is split.
+func (c *checkpoint) stagedName(output, block string) string {
+	rel, err := filepath.Rel(c.dir, output)
+	if err != nil {
+		return filepath.Base(block)
+	}
+
+	return filepath.Join(rel, filepath.Base(block))
+}
+
+func (c *checkpoint) save() error {
+	b, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(c.dir, checkpointFileName)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Remove deletes the checkpoint after the conversion is complete.
+func (c *checkpoint) Remove() error {
+	return os.Remove(filepath.Join(c.dir, checkpointFileName))
+}
+
+// removeTemporaryBlocks removes blocks which have not been written completely.
+func removeTemporaryBlocks(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+
+	for _, fi := range files {
+		if !fi.IsDir() || !strings.HasSuffix(fi.Name(), ".tmp") {
+			continue
+		}
+
+		path := filepath.Join(dir, fi.Name())
+		log.Printf("Removing incomplete block: %s", path)
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("error removing block: %s", err)
+		}
+	}
+
+	return nil
+}
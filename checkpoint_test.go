@@ -0,0 +1,186 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	cfg "github.com/xperimental/tsdb-migrate/config"
+)
+
+func TestCheckpointSaveLoad(t *testing.T) {
+	const hour = int64(time.Hour / time.Millisecond)
+	step := 2 * time.Hour
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(48 * time.Hour)
+
+	for _, mode := range []string{cfg.ModeTime, cfg.ModeSeries} {
+		t.Run(mode, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "tsdb-migrate")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			staging := filepath.Join(dir, stagingDirName)
+			cp := newCheckpoint(dir, mode, step, start, end, false)
+			cp.DownsampleRef = end.Add(time.Hour)
+			switch mode {
+			case cfg.ModeSeries:
+				writeTestBlock(t, staging, 0, 2*hour)
+				err = cp.SaveSeries(0x10)
+				// Blocks of series after the checkpoint.
+				writeTestBlock(t, staging, 2*hour, 4*hour)
+			default:
+				err = cp.SaveWindow(start.Add(step))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.MkdirAll(filepath.Join(dir, "01C0000000000000000000000.tmp"), 0777); err != nil {
+				t.Fatal(err)
+			}
+
+			loaded, err := loadCheckpoint(dir, mode, step, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !loaded.Start.Equal(start) || !loaded.End.Equal(end) {
+				t.Errorf("got range %s - %s, want %s - %s", loaded.Start, loaded.End, start, end)
+			}
+			if want := end.Add(time.Hour); !loaded.DownsampleRef.Equal(want) {
+				t.Errorf("got downsampling reference %s, want %s", loaded.DownsampleRef, want)
+			}
+
+			files, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, fi := range files {
+				if strings.HasSuffix(fi.Name(), ".tmp") {
+					t.Errorf("incomplete block %s has not been removed", fi.Name())
+				}
+			}
+
+			switch mode {
+			case cfg.ModeSeries:
+				fp, ok := loaded.Fingerprint()
+				if !ok || fp != model.Fingerprint(0x10) {
+					t.Errorf("got fingerprint %s (%t), want %s", fp, ok, model.Fingerprint(0x10))
+				}
+
+				staged, err := blockDirs(staging)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(staged) != 1 || !reflect.DeepEqual(loaded.Staged, []string{filepath.Base(staged[0])}) {
+					t.Errorf("got staged blocks %v, checkpoint %v, want the first block", staged, loaded.Staged)
+				}
+			default:
+				if want := start.Add(step); !loaded.WindowEnd.Equal(want) {
+					t.Errorf("got window end %s, want %s", loaded.WindowEnd, want)
+				}
+			}
+
+			if err := loaded.Remove(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadCheckpoint(dir, mode, step, false); !os.IsNotExist(err) {
+				t.Errorf("got error %v after removing the checkpoint, want not exist", err)
+			}
+		})
+	}
+}
+
+func TestLoadCheckpointMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsdb-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		name  string
+		saved *checkpoint
+		mode  string
+		step  time.Duration
+		split bool
+		err   string
+	}{
+		{
+			name:  "mode",
+			saved: newCheckpoint(dir, cfg.ModeSeries, time.Hour, start, start.Add(time.Hour), false),
+			mode:  cfg.ModeTime,
+			step:  time.Hour,
+			err:   "created in series mode",
+		},
+		{
+			name:  "step",
+			saved: newCheckpoint(dir, cfg.ModeTime, 2*time.Hour, start, start.Add(time.Hour), false),
+			mode:  cfg.ModeTime,
+			step:  time.Hour,
+			err:   "created with step 2h0m0s",
+		},
+		{
+			name:  "split",
+			saved: newCheckpoint(dir, cfg.ModeTime, time.Hour, start, start.Add(time.Hour), false),
+			mode:  cfg.ModeTime,
+			step:  time.Hour,
+			split: true,
+			err:   "different output split",
+		},
+		{
+			name:  "no time range",
+			saved: newCheckpoint(dir, cfg.ModeTime, time.Hour, time.Time{}, time.Time{}, false),
+			mode:  cfg.ModeTime,
+			step:  time.Hour,
+			err:   "no time range",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.saved.save(); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := loadCheckpoint(dir, test.mode, test.step, test.split)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+// TestSkipFirstWindow checks that a block covering the unaligned start is
+// skipped if it has been written before the checkpoint was saved.
+func TestSkipFirstWindow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsdb-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const hour = int64(time.Hour / time.Millisecond)
+	step := 2 * time.Hour
+	writeTestBlock(t, dir, 0, 2*hour)
+
+	cp := newCheckpoint(dir, cfg.ModeTime, step, timeFromMillis(hour/2), timeFromMillis(6*hour), false)
+	if err := cp.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	cp, err = loadCheckpoint(dir, cfg.ModeTime, step, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := timeFromMillis(2 * hour); !cp.WindowEnd.Equal(want) {
+		t.Errorf("got window end %s, want %s", cp.WindowEnd, want)
+	}
+}
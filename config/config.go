@@ -3,63 +3,749 @@ package config
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/prometheus/common/model"
+	promconfig "github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/metric"
 	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
 )
 
 // MigrateConfig contains the configuration of the migration tool.
 type MigrateConfig struct {
-	InputDirectory  string
-	OutputDirectory string
-	RetentionTime   time.Duration
-	StartTime       time.Time
-	StepTime        time.Duration
+	Command          string
+	InputDirectories []string
+	OutputDirectory  string
+	OutputTemplate   string
+	Routes           []Route
+	RouteDefault     string
+	RetentionTime    time.Duration
+	StartTime        time.Time
+	EndTime          time.Time
+	StepTime         time.Duration
+	Mode             string
+	BatchSize        int
+	MaxBatchSamples  int64
+	Reader           string
+	Resume           bool
+	Matchers         []metric.LabelMatchers
+	RelabelConfigs   []*promconfig.RelabelConfig
+	Workers          int
+	ListenAddress    string
+	ReportFile       string
+	DeadLetterFile   string
+	TopN             int
+	DryRun           bool
+	MinStepTime      time.Duration
+	MaxSeries        int
+	MaxSamples       int64
+	MemoryBudget     uint64
+	DedupePolicy     string
+	DedupeTolerance  time.Duration
+	ExternalLabels   model.LabelSet
+	LabelConflict    string
+	StaleMarkers     bool
+	StaleGapFactor   float64
+	Downsampling     []DownsampleRule
+	DownsampleRef    time.Time
+	Strategies       []DownsampleStrategy
 }
 
+// Route sends the series matching the matchers to a directory relative to the
+// output directory.
+type Route struct {
+	Directory string
+	Matchers  metric.LabelMatchers
+}
+
+// DownsampleRule reduces the samples older than Age, counted back from the
+// downsampling reference time, to one sample per Resolution.
+type DownsampleRule struct {
+	Age        time.Duration
+	Resolution time.Duration
+}
+
+// DownsampleStrategy selects how the samples of the series whose metric name
+// matches Pattern are reduced.
+type DownsampleStrategy struct {
+	Pattern  *regexp.Regexp
+	Strategy string
+}
+
+// defaultStrategies are used for the series not matching any configured
+// strategy: metric names ending like those of counters are reduced as
+// counters, everything else keeps the last value.
+var defaultStrategies = []DownsampleStrategy{
+	{
+		Pattern:  regexp.MustCompile(`^(?:.+_(total|count|sum|bucket))$`),
+		Strategy: DownsampleCounter,
+	},
+	{
+		Pattern:  regexp.MustCompile(`^(?:.*)$`),
+		Strategy: DownsampleLast,
+	},
+}
+
+// PlaceholderPattern matches the label placeholders in an output template.
+var PlaceholderPattern = regexp.MustCompile(`\{\{\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*\}\}`)
+
+const (
+	// CommandMigrate converts the input to TSDB blocks.
+	CommandMigrate = "migrate"
+	// CommandVerify compares the converted output with the input.
+	CommandVerify = "verify"
+	// CommandInspect summarizes the input storage.
+	CommandInspect = "inspect"
+	// CommandInspectBlocks summarizes the blocks in the output directory.
+	CommandInspectBlocks = "inspect-blocks"
+	// CommandReverse copies the output back into the input storage.
+	CommandReverse = "reverse"
+
+	// ModeTime converts the input one time slice at a time.
+	ModeTime = "time"
+	// ModeSeries converts the input one series at a time.
+	ModeSeries = "series"
+
+	// ReaderStorage reads the input by starting the 1.x storage engine.
+	ReaderStorage = "storage"
+	// ReaderDirect reads the input files directly without modifying them.
+	ReaderDirect = "direct"
+
+	// DedupeDropWithinTolerance drops the samples which follow the previous
+	// sample of a merged series within the tolerance.
+	DedupeDropWithinTolerance = "drop-within-tolerance"
+	// DedupePreferFirst uses the samples of later inputs only where the
+	// earlier inputs have no sample within the tolerance.
+	DedupePreferFirst = "prefer-first"
+
+	// LabelConflictOverwrite replaces the value of an existing label with the
+	// external label.
+	LabelConflictOverwrite = "overwrite"
+	// LabelConflictKeep keeps the value of an existing label.
+	LabelConflictKeep = "keep"
+	// LabelConflictFail stops the migration if a series has a different value
+	// for an external label.
+	LabelConflictFail = "fail"
+
+	// DownsampleCounter keeps the last sample of every interval and the last
+	// sample before every counter reset.
+	DownsampleCounter = "counter"
+	// DownsampleLast keeps the last sample of every interval.
+	DownsampleLast = "last"
+	// DownsampleAverage replaces the samples of every interval with their
+	// average at the time of the last sample.
+	DownsampleAverage = "avg"
+)
+
 var defaultConfig = MigrateConfig{
-	InputDirectory:  "",
+	Command:         CommandMigrate,
 	OutputDirectory: "",
 	RetentionTime:   15 * 24 * time.Hour,
-	StartTime:       time.Date(2016, 7, 18, 14, 37, 0, 0, time.UTC),
 	StepTime:        24 * time.Hour,
+	Mode:            ModeTime,
+	BatchSize:       1000,
+	MaxBatchSamples: 20000000,
+	Reader:          ReaderStorage,
+	Workers:         1,
+	TopN:            10,
+	MinStepTime:     5 * time.Minute,
+	DedupePolicy:    DedupeDropWithinTolerance,
+	LabelConflict:   LabelConflictFail,
+	StaleGapFactor:  2,
 }
 
 // ParseFlags creates a new configuration from the command-line parameters.
 func ParseFlags() (MigrateConfig, error) {
 	config := defaultConfig
 
-	startTimeStr := config.StartTime.Format(time.RFC3339)
+	startTimeStr := ""
+	endTimeStr := ""
+	selectors := []string{}
+	relabelFile := ""
+	routes := []string{}
+	addLabels := []string{}
+	externalLabelsFile := ""
+	downsampling := []string{}
+	downsampleRefStr := ""
+	strategies := []string{}
+	memoryBudgetStr := ""
 
-	pflag.StringVarP(&config.InputDirectory, "input", "i", config.InputDirectory, "Directory of local storage to convert.")
-	pflag.StringVarP(&config.OutputDirectory, "output", "o", config.OutputDirectory, "Directory for new TSDB database.")
-	pflag.DurationVarP(&config.RetentionTime, "retention", "r", config.RetentionTime, "Retention time of new database.")
-	pflag.StringVarP(&startTimeStr, "start-time", "s", startTimeStr, "Starting time for conversion process.")
-	pflag.DurationVar(&config.StepTime, "step-time", config.StepTime, "Time slice to use for copying values.")
+	pflag.StringArrayVarP(&config.InputDirectories, "input", "i", config.InputDirectories, "Directory of local storage to convert. Can be repeated to merge the series of several storages, for example of the replicas of an HA pair.")
+	pflag.StringVarP(&config.OutputDirectory, "output", "o", config.OutputDirectory, "Directory for new TSDB database. Can contain label placeholders like \"out/{{team}}\" to split the series into one database per label value.")
+	pflag.StringArrayVar(&routes, "route", routes, "Route the series matching a selector to a database in a directory relative to the output, for example 'team-a={team=\"a\"}'. Can be repeated, the first matching route is used.")
+	pflag.StringVar(&config.RouteDefault, "route-default", config.RouteDefault, "Directory relative to the output for the series not matching a route or missing a label of the output template. These series are skipped if empty.")
+	pflag.DurationVarP(&config.RetentionTime, "retention", "r", config.RetentionTime, "Retention time of the input storage. The inspect-blocks command reports blocks outside of it.")
+	pflag.StringVarP(&startTimeStr, "start-time", "s", startTimeStr, "Starting time for conversion process. Accepts RFC3339, Unix milliseconds or a duration relative to now like \"-30d\". Defaults to the oldest sample in the input.")
+	pflag.StringVarP(&endTimeStr, "end-time", "e", endTimeStr, "End time (exclusive) for conversion process in the same formats as the start time. Defaults to just after the newest sample in the input.")
+	pflag.DurationVar(&config.StepTime, "step-time", config.StepTime, "Time slice to use for copying values. With window limits this is the largest time slice.")
+	pflag.DurationVar(&config.MinStepTime, "min-step-time", config.MinStepTime, "Smallest time slice the step is reduced to if a window exceeds one of the limits.")
+	pflag.IntVar(&config.MaxSeries, "max-window-series", config.MaxSeries, "Reduce the step in time mode if a window contains more series. Disabled if zero.")
+	pflag.Int64Var(&config.MaxSamples, "max-window-samples", config.MaxSamples, "Reduce the step in time mode if a window contains more samples. Disabled if zero.")
+	pflag.StringVar(&memoryBudgetStr, "memory-budget", memoryBudgetStr, "Reduce the step in time mode if the heap grows larger while converting a window, for example \"4GiB\". Disabled if empty.")
+	pflag.StringVar(&config.Mode, "mode", config.Mode, "Conversion mode: \"time\" copies all series one time slice at a time, \"series\" copies the full history of one series at a time.")
+	pflag.IntVar(&config.BatchSize, "batch-size", config.BatchSize, "Number of series to keep in memory before writing blocks in series mode.")
+	pflag.Int64Var(&config.MaxBatchSamples, "max-batch-samples", config.MaxBatchSamples, "Halve the batch size in series mode if a batch contains more samples. Disabled if zero.")
+	pflag.StringVar(&config.DedupePolicy, "dedupe-policy", config.DedupePolicy, "Merging of series found in several inputs: \"drop-within-tolerance\" drops samples following the previous sample within the tolerance, \"prefer-first\" uses samples of later inputs only where the earlier inputs have no sample within the tolerance.")
+	pflag.DurationVar(&config.DedupeTolerance, "dedupe-tolerance", config.DedupeTolerance, "Samples of merged series closer than this are duplicates. Zero only deduplicates identical timestamps.")
+	pflag.StringVar(&config.Reader, "reader", config.Reader, "Input reader: \"storage\" starts the 1.x storage engine, \"direct\" reads the files without writing to the input directory.")
+	pflag.BoolVar(&config.Resume, "resume", config.Resume, "Continue an interrupted conversion from the checkpoint in the output directory.")
+	pflag.StringArrayVar(&selectors, "match", selectors, "Series selector of the series to convert, for example '{job=\"node\"}'. Can be repeated to convert the series matching any of the selectors. Defaults to all series, including series without a metric name.")
+	pflag.StringVar(&relabelFile, "relabel-config", relabelFile, "YAML file with relabel_configs which are applied to every series before it is converted.")
+	pflag.StringArrayVar(&addLabels, "add-label", addLabels, "Label added to every converted series as name=value. Can be repeated. Takes precedence over the labels of --external-labels-from.")
+	pflag.StringVar(&externalLabelsFile, "external-labels-from", externalLabelsFile, "Prometheus configuration file whose global external_labels are added to every converted series.")
+	pflag.StringVar(&config.LabelConflict, "label-conflict", config.LabelConflict, "Handling of series which already have an added label with a different value: \"overwrite\" replaces the value, \"keep\" keeps the value of the series, \"fail\" stops the migration.")
+	pflag.BoolVar(&config.StaleMarkers, "staleness-markers", config.StaleMarkers, "Insert staleness markers after the last sample of a series and after gaps in it, like Prometheus 2 does when a target disappears. Only series scraped more often than every five minutes get markers.")
+	pflag.Float64Var(&config.StaleGapFactor, "staleness-gap-factor", config.StaleGapFactor, "Gaps longer than this many scrape intervals get a staleness marker. The scrape interval of a series is inferred from its samples.")
+	pflag.StringArrayVar(&downsampling, "downsample", downsampling, "Reduce the samples older than an age, counted back from the reference time, to one sample per resolution, as age=resolution like \"30d=5m\". Can be repeated for several ages.")
+	pflag.StringVar(&downsampleRefStr, "downsample-reference", downsampleRefStr, "Time the age of the samples is counted back from when downsampling, in the same formats as the start time. Defaults to the start of the run.")
+	pflag.StringArrayVar(&strategies, "downsample-strategy", strategies, "Reduction of the series whose metric name matches a regular expression, as pattern=strategy with \"counter\", \"last\" or \"avg\". Can be repeated, the first match is used. Metric names ending in _total, _count, _sum or _bucket default to \"counter\", all others to \"last\".")
+	pflag.IntVar(&config.Workers, "workers", config.Workers, "Number of series converted concurrently. The series are distributed to the workers by fingerprint.")
+	pflag.StringVar(&config.ListenAddress, "web.listen-address", config.ListenAddress, "Address to serve metrics about the conversion on, for example \":9099\". Disabled if empty.")
+	pflag.StringVar(&config.ReportFile, "report", config.ReportFile, "File to write a JSON report about the conversion to at the end of the run. Disabled if empty.")
+	pflag.StringVar(&config.DeadLetterFile, "dead-letter", config.DeadLetterFile, "File to write samples to which could not be appended, one JSON object per line with labels, timestamp, value and reason. Disabled if empty.")
+	pflag.BoolVar(&config.DryRun, "dry-run", config.DryRun, "Read the input and estimate the size, memory and duration of a migration in time mode without window limits, without writing the output.")
+	pflag.IntVar(&config.TopN, "top", config.TopN, "Number of metric and label names shown by the inspect command.")
+	pflag.Usage = usage
 	pflag.Parse()
 
-	if err := checkDirectory(config.InputDirectory); err != nil {
-		return config, fmt.Errorf("error checking input: %s", err)
+	switch pflag.NArg() {
+	case 0:
+	case 1:
+		config.Command = pflag.Arg(0)
+	default:
+		return config, fmt.Errorf("too many arguments: %s", pflag.Args())
 	}
 
-	if err := checkDirectory(config.OutputDirectory); err != nil {
-		return config, fmt.Errorf("error checking output: %s", err)
+	switch config.Command {
+	case CommandMigrate, CommandVerify, CommandInspect, CommandInspectBlocks, CommandReverse:
+	default:
+		return config, fmt.Errorf("unknown command: %s", config.Command)
 	}
 
-	startTime, err := time.Parse(time.RFC3339, startTimeStr)
-	if err != nil {
-		return config, fmt.Errorf("error parsing start time: %s", err)
+	if config.Command != CommandInspectBlocks {
+		if len(config.InputDirectories) == 0 {
+			pflag.Usage()
+			return config, errors.New("error checking input: not specified")
+		}
+
+		seen := make(map[string]bool)
+		for _, dir := range config.InputDirectories {
+			if err := checkDirectory(dir); err != nil {
+				return config, fmt.Errorf("error checking input: %s", err)
+			}
+
+			if seen[dir] {
+				return config, fmt.Errorf("input given more than once: %s", dir)
+			}
+			seen[dir] = true
+		}
+	}
+
+	if config.Command == CommandInspect && len(config.InputDirectories) > 1 {
+		return config, errors.New("inspect supports only one input")
+	}
+
+	if config.Command == CommandReverse {
+		if len(config.InputDirectories) > 1 {
+			return config, errors.New("reverse supports only one input")
+		}
+
+		if config.Reader == ReaderDirect || config.DryRun {
+			return config, errors.New("reverse writes to the input and can not use the direct reader or a dry run")
+		}
+	}
+
+	if strings.Contains(config.OutputDirectory, "{{") {
+		root, template, err := splitOutputTemplate(config.OutputDirectory)
+		if err != nil {
+			return config, fmt.Errorf("error parsing output template: %s", err)
+		}
+		config.OutputDirectory, config.OutputTemplate = root, template
+	}
+
+	for _, r := range routes {
+		route, err := parseRoute(r)
+		if err != nil {
+			return config, fmt.Errorf("error parsing route %q: %s", r, err)
+		}
+		config.Routes = append(config.Routes, route)
+	}
+
+	if config.OutputTemplate != "" && len(config.Routes) > 0 {
+		return config, errors.New("routes can not be combined with an output template")
+	}
+
+	if config.RouteDefault != "" {
+		if !config.Split() {
+			return config, errors.New("default route needs an output template or routes")
+		}
+
+		if err := checkOutputSubdir(config.RouteDefault); err != nil {
+			return config, fmt.Errorf("error checking default route: %s", err)
+		}
+	}
+
+	if config.Split() && (config.Command == CommandInspectBlocks || config.Command == CommandReverse) {
+		return config, fmt.Errorf("%s needs a single output directory", config.Command)
+	}
+
+	if config.Command != CommandInspect && !config.DryRun {
+		if err := checkDirectory(config.OutputDirectory); err != nil {
+			return config, fmt.Errorf("error checking output: %s", err)
+		}
+	}
+
+	now := time.Now()
+	if startTimeStr != "" {
+		startTime, err := parseTime(startTimeStr, now)
+		if err != nil {
+			return config, fmt.Errorf("error parsing start time: %s", err)
+		}
+		config.StartTime = startTime
+	}
+
+	if endTimeStr != "" {
+		endTime, err := parseTime(endTimeStr, now)
+		if err != nil {
+			return config, fmt.Errorf("error parsing end time: %s", err)
+		}
+		config.EndTime = endTime
+	}
+
+	config.DownsampleRef = now
+	if downsampleRefStr != "" {
+		downsampleRef, err := parseTime(downsampleRefStr, now)
+		if err != nil {
+			return config, fmt.Errorf("error parsing downsampling reference: %s", err)
+		}
+		config.DownsampleRef = downsampleRef
+	}
+
+	if !config.StartTime.IsZero() && !config.EndTime.IsZero() && !config.StartTime.Before(config.EndTime) {
+		return config, fmt.Errorf("start time %s is not before end time %s", config.StartTime, config.EndTime)
 	}
-	config.StartTime = startTime
 
 	if config.StepTime < time.Hour {
 		return config, fmt.Errorf("step too small (min. 1 hour): %s", config.StepTime)
 	}
 
+	switch config.Mode {
+	case ModeTime, ModeSeries:
+	default:
+		return config, fmt.Errorf("unknown mode: %s", config.Mode)
+	}
+
+	if memoryBudgetStr != "" {
+		memoryBudget, err := parseBytes(memoryBudgetStr)
+		if err != nil {
+			return config, fmt.Errorf("error parsing memory budget: %s", err)
+		}
+		config.MemoryBudget = memoryBudget
+	}
+
+	if config.MaxSeries < 0 || config.MaxSamples < 0 {
+		return config, errors.New("window limits can not be negative")
+	}
+
+	if config.MaxSeries > 0 || config.MaxSamples > 0 || config.MemoryBudget > 0 {
+		if config.Mode != ModeTime {
+			return config, errors.New("window limits are only supported in time mode")
+		}
+
+		if config.MinStepTime < time.Minute || config.MinStepTime > config.StepTime {
+			return config, fmt.Errorf("minimum step needs to be between 1 minute and the step: %s", config.MinStepTime)
+		}
+	}
+
+	// The estimates are based on the fixed windows of time mode.
+	if config.DryRun {
+		if config.Mode != ModeTime {
+			return config, errors.New("dry run is only supported in time mode")
+		}
+
+		if config.MaxSeries > 0 || config.MaxSamples > 0 || config.MemoryBudget > 0 {
+			return config, errors.New("dry run does not support window limits")
+		}
+	}
+
+	switch config.Reader {
+	case ReaderStorage, ReaderDirect:
+	default:
+		return config, fmt.Errorf("unknown reader: %s", config.Reader)
+	}
+
+	switch config.DedupePolicy {
+	case DedupeDropWithinTolerance, DedupePreferFirst:
+	default:
+		return config, fmt.Errorf("unknown dedupe policy: %s", config.DedupePolicy)
+	}
+
+	if config.DedupeTolerance < 0 {
+		return config, fmt.Errorf("dedupe tolerance can not be negative: %s", config.DedupeTolerance)
+	}
+
+	if config.StaleGapFactor <= 1 {
+		return config, fmt.Errorf("staleness gap factor needs to be larger than one: %g", config.StaleGapFactor)
+	}
+
+	for _, selector := range selectors {
+		matchers, err := promql.ParseMetricSelector(selector)
+		if err != nil {
+			return config, fmt.Errorf("error parsing selector %q: %s", selector, err)
+		}
+		config.Matchers = append(config.Matchers, matchers)
+	}
+
+	if relabelFile != "" {
+		relabelConfigs, err := loadRelabelConfigs(relabelFile)
+		if err != nil {
+			return config, fmt.Errorf("error loading relabel config: %s", err)
+		}
+		config.RelabelConfigs = relabelConfigs
+	}
+
+	if externalLabelsFile != "" {
+		externalLabels, err := loadExternalLabels(externalLabelsFile)
+		if err != nil {
+			return config, fmt.Errorf("error loading external labels: %s", err)
+		}
+		config.ExternalLabels = externalLabels
+	}
+
+	for _, l := range addLabels {
+		name, value, err := parseLabel(l)
+		if err != nil {
+			return config, fmt.Errorf("error parsing label %q: %s", l, err)
+		}
+
+		if config.ExternalLabels == nil {
+			config.ExternalLabels = model.LabelSet{}
+		}
+		config.ExternalLabels[name] = value
+	}
+
+	switch config.LabelConflict {
+	case LabelConflictOverwrite, LabelConflictKeep, LabelConflictFail:
+	default:
+		return config, fmt.Errorf("unknown label conflict policy: %s", config.LabelConflict)
+	}
+
+	for _, d := range downsampling {
+		rule, err := parseDownsampleRule(d)
+		if err != nil {
+			return config, fmt.Errorf("error parsing downsampling rule %q: %s", d, err)
+		}
+
+		// Otherwise the intervals of the resolution cross the windows.
+		for _, width := range config.windowWidths() {
+			if width%rule.Resolution != 0 {
+				return config, fmt.Errorf("downsampling resolution %s does not divide the window width %s", rule.Resolution, width)
+			}
+		}
+		config.Downsampling = append(config.Downsampling, rule)
+	}
+	sort.Slice(config.Downsampling, func(i, j int) bool {
+		return config.Downsampling[i].Age < config.Downsampling[j].Age
+	})
+
+	for i := 1; i < len(config.Downsampling); i++ {
+		if config.Downsampling[i].Age == config.Downsampling[i-1].Age {
+			return config, fmt.Errorf("duplicate downsampling age: %s", config.Downsampling[i].Age)
+		}
+	}
+
+	for _, s := range strategies {
+		strategy, err := parseDownsampleStrategy(s)
+		if err != nil {
+			return config, fmt.Errorf("error parsing downsampling strategy %q: %s", s, err)
+		}
+		config.Strategies = append(config.Strategies, strategy)
+	}
+	config.Strategies = append(config.Strategies, defaultStrategies...)
+
+	if config.Workers < 1 {
+		return config, fmt.Errorf("number of workers too small (min. 1): %d", config.Workers)
+	}
+
+	if config.TopN < 1 {
+		return config, fmt.Errorf("number of names too small (min. 1): %d", config.TopN)
+	}
+
+	if config.BatchSize < 1 {
+		return config, fmt.Errorf("batch size too small (min. 1): %d", config.BatchSize)
+	}
+
+	if config.MaxBatchSamples < 0 {
+		return config, errors.New("batch limit can not be negative")
+	}
+
 	return config, nil
 }
 
+// parseTime parses an RFC3339 timestamp, Unix milliseconds or a negative
+// duration relative to now.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if strings.HasPrefix(s, "-") {
+		d, err := model.ParseDuration(s[1:])
+		if err != nil {
+			return time.Time{}, err
+		}
+		return now.Add(-time.Duration(d)), nil
+	}
+
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(0, ms*int64(time.Millisecond)).UTC(), nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+// parseBytes parses a number of bytes with an optional binary unit like "512MiB".
+func parseBytes(s string) (uint64, error) {
+	units := []struct {
+		suffix string
+		factor uint64
+	}{
+		{"KiB", 1 << 10},
+		{"MiB", 1 << 20},
+		{"GiB", 1 << 30},
+		{"TiB", 1 << 40},
+		{"B", 1},
+	}
+
+	factor := uint64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSuffix(s, u.suffix)
+			factor = u.factor
+			break
+		}
+	}
+
+	n, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return n * factor, nil
+}
+
+type relabelConfigFile struct {
+	RelabelConfigs []*promconfig.RelabelConfig `yaml:"relabel_configs"`
+}
+
+func loadRelabelConfigs(filename string) ([]*promconfig.RelabelConfig, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var file relabelConfigFile
+	if err := yaml.Unmarshal(b, &file); err != nil {
+		return nil, err
+	}
+
+	return file.RelabelConfigs, nil
+}
+
+// Split returns true if the series are written to several output directories.
+func (c MigrateConfig) Split() bool {
+	return c.OutputTemplate != "" || len(c.Routes) > 0
+}
+
+// splitOutputTemplate splits an output directory with label placeholders into
+// the directory before the first placeholder and the template relative to it.
+func splitOutputTemplate(output string) (string, string, error) {
+	output = filepath.Clean(output)
+	i := strings.Index(output, "{{")
+	if i < 0 {
+		return "", "", fmt.Errorf("no placeholder left in cleaned path %q", output)
+	}
+	root := filepath.Dir(output[:i] + "x")
+	template, err := filepath.Rel(root, output)
+	if err != nil {
+		return "", "", err
+	}
+
+	if PlaceholderPattern.FindStringIndex(template) == nil || strings.Contains(PlaceholderPattern.ReplaceAllString(template, ""), "{{") {
+		return "", "", fmt.Errorf("invalid placeholder in %q", template)
+	}
+
+	if err := checkOutputSubdir(template); err != nil {
+		return "", "", err
+	}
+
+	return root, template, nil
+}
+
+// parseRoute parses a route in the form directory=selector.
+func parseRoute(s string) (Route, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return Route{}, errors.New("expected directory=selector")
+	}
+
+	if err := checkOutputSubdir(parts[0]); err != nil {
+		return Route{}, err
+	}
+
+	matchers, err := promql.ParseMetricSelector(parts[1])
+	if err != nil {
+		return Route{}, fmt.Errorf("error parsing selector: %s", err)
+	}
+
+	return Route{
+		Directory: parts[0],
+		Matchers:  matchers,
+	}, nil
+}
+
+// checkOutputSubdir returns an error if dir is not a directory below the
+// output directory.
+func checkOutputSubdir(dir string) error {
+	if filepath.IsAbs(dir) || filepath.Clean(dir) != dir || dir == "." || dir == ".." || strings.HasPrefix(dir, "../") {
+		return fmt.Errorf("not a directory below the output directory: %s", dir)
+	}
+
+	return nil
+}
+
+type prometheusConfigFile struct {
+	Global struct {
+		ExternalLabels model.LabelSet `yaml:"external_labels"`
+	} `yaml:"global"`
+}
+
+func loadExternalLabels(filename string) (model.LabelSet, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var file prometheusConfigFile
+	if err := yaml.Unmarshal(b, &file); err != nil {
+		return nil, err
+	}
+
+	for name, value := range file.Global.ExternalLabels {
+		if value == "" {
+			return nil, fmt.Errorf("empty value of label %q", name)
+		}
+	}
+
+	return file.Global.ExternalLabels, nil
+}
+
+// parseLabel parses a label in the form name=value.
+func parseLabel(s string) (model.LabelName, model.LabelValue, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return "", "", errors.New("expected name=value")
+	}
+
+	name, value := model.LabelName(parts[0]), model.LabelValue(parts[1])
+	if !name.IsValid() {
+		return "", "", fmt.Errorf("invalid label name %q", name)
+	}
+
+	if value == "" {
+		return "", "", fmt.Errorf("empty value of label %q", name)
+	}
+
+	return name, value, nil
+}
+
+// windowWidths returns the step and, if the window limits are enabled, the
+// widths it can be halved to.
+func (c MigrateConfig) windowWidths() []time.Duration {
+	widths := []time.Duration{c.StepTime}
+	if c.MaxSeries == 0 && c.MaxSamples == 0 && c.MemoryBudget == 0 {
+		return widths
+	}
+
+	for width := c.StepTime; width%(2*time.Millisecond) == 0 && width/2 >= c.MinStepTime; width /= 2 {
+		widths = append(widths, width/2)
+	}
+	return widths
+}
+
+// parseDownsampleRule parses a rule in the format "age=resolution".
+func parseDownsampleRule(s string) (DownsampleRule, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return DownsampleRule{}, errors.New("expected age=resolution")
+	}
+
+	age, err := model.ParseDuration(parts[0])
+	if err != nil {
+		return DownsampleRule{}, fmt.Errorf("error parsing age: %s", err)
+	}
+
+	resolution, err := model.ParseDuration(parts[1])
+	if err != nil {
+		return DownsampleRule{}, fmt.Errorf("error parsing resolution: %s", err)
+	}
+
+	if time.Duration(resolution) < time.Second {
+		return DownsampleRule{}, fmt.Errorf("resolution too small (min. 1 second): %s", resolution)
+	}
+
+	return DownsampleRule{
+		Age:        time.Duration(age),
+		Resolution: time.Duration(resolution),
+	}, nil
+}
+
+// parseDownsampleStrategy parses a strategy in the format "pattern=strategy".
+// The pattern is anchored like the regular expressions in selectors.
+func parseDownsampleStrategy(s string) (DownsampleStrategy, error) {
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return DownsampleStrategy{}, errors.New("expected pattern=strategy")
+	}
+
+	pattern, err := regexp.Compile("^(?:" + s[:i] + ")$")
+	if err != nil {
+		return DownsampleStrategy{}, fmt.Errorf("error parsing pattern: %s", err)
+	}
+
+	strategy := s[i+1:]
+	switch strategy {
+	case DownsampleCounter, DownsampleLast, DownsampleAverage:
+	default:
+		return DownsampleStrategy{}, fmt.Errorf("unknown strategy: %s", strategy)
+	}
+
+	return DownsampleStrategy{
+		Pattern:  pattern,
+		Strategy: strategy,
+	}, nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s [command] [flags]
+
+Commands:
+  migrate          Convert the input to TSDB blocks (default).
+  verify           Compare the converted output with the input.
+  inspect          Summarize the input storage.
+  inspect-blocks   Summarize the blocks in the output directory.
+  reverse          Copy the output back into the input storage.
+
+Flags:
+`, os.Args[0])
+	pflag.PrintDefaults()
+}
+
 func checkDirectory(dir string) error {
 	if dir == "" {
 		pflag.Usage()
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		input string
+		want  time.Time
+		err   bool
+	}{
+		{input: "2017-09-01T00:00:00Z", want: time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)},
+		{input: "2017-09-01T02:00:00+02:00", want: time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)},
+		{input: "1504224000000", want: time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)},
+		{input: "1504224000123", want: time.Date(2017, 9, 1, 0, 0, 0, 123*int(time.Millisecond), time.UTC)},
+		{input: "0", want: time.Unix(0, 0)},
+		{input: "-30d", want: now.Add(-30 * 24 * time.Hour)},
+		{input: "-90m", want: now.Add(-90 * time.Minute)},
+		{input: "-1w", want: now.Add(-7 * 24 * time.Hour)},
+		{input: "-30", err: true},
+		{input: "-1.5h", err: true},
+		{input: "30d", err: true},
+		{input: "2017-09-01", err: true},
+		{input: "", err: true},
+	} {
+		got, err := parseTime(test.input, now)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: got %s, want error", test.input, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: got error: %s", test.input, err)
+			continue
+		}
+
+		if !got.Equal(test.want) {
+			t.Errorf("%q: got %s, want %s", test.input, got, test.want)
+		}
+	}
+}
+
+func TestWindowWidths(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		config MigrateConfig
+		want   []time.Duration
+	}{
+		{
+			name:   "no limits",
+			config: MigrateConfig{StepTime: 24 * time.Hour, MinStepTime: time.Hour},
+			want:   []time.Duration{24 * time.Hour},
+		},
+		{
+			name:   "halved to min step",
+			config: MigrateConfig{StepTime: 4 * time.Hour, MinStepTime: time.Hour, MaxSeries: 1},
+			want:   []time.Duration{4 * time.Hour, 2 * time.Hour, time.Hour},
+		},
+		{
+			name:   "min step not reached",
+			config: MigrateConfig{StepTime: 3 * time.Hour, MinStepTime: 40 * time.Minute, MaxSamples: 1},
+			want:   []time.Duration{3 * time.Hour, 90 * time.Minute, 45 * time.Minute},
+		},
+		{
+			name:   "min step equals step",
+			config: MigrateConfig{StepTime: time.Hour, MinStepTime: time.Hour, MemoryBudget: 1},
+			want:   []time.Duration{time.Hour},
+		},
+	} {
+		if got := test.config.windowWidths(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSplitOutputTemplate(t *testing.T) {
+	for _, test := range []struct {
+		output   string
+		root     string
+		template string
+		err      string
+	}{
+		{output: "out/{{team}}", root: "out", template: "{{team}}"},
+		{output: "/data/out/{{ team }}/{{env}}", root: "/data/out", template: "{{ team }}/{{env}}"},
+		{output: "out/team-{{team}}/data", root: "out", template: "team-{{team}}/data"},
+		{output: "{{team}}", root: ".", template: "{{team}}"},
+		{output: "out/{{team}", err: "invalid placeholder"},
+		{output: "out/{{1team}}", err: "invalid placeholder"},
+		{output: "out/{{team}}/{{", err: "invalid placeholder"},
+		{output: "out/{{team}}/..", err: "no placeholder left"},
+		{output: "out/{{team}}/../a", err: "no placeholder left"},
+	} {
+		root, template, err := splitOutputTemplate(test.output)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want %q", test.output, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: got error: %s", test.output, err)
+			continue
+		}
+
+		if root != test.root || template != test.template {
+			t.Errorf("%s: got %q and %q, want %q and %q", test.output, root, template, test.root, test.template)
+		}
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	for _, test := range []struct {
+		route     string
+		directory string
+		matchers  string
+		err       string
+	}{
+		{route: `team-a={team="a"}`, directory: "team-a", matchers: `team="a"`},
+		{route: `a/b=up{job=~"a|b"}`, directory: "a/b", matchers: `job=~"a|b",__name__="up"`},
+		{route: `team-a`, err: "expected directory=selector"},
+		{route: `../a={team="a"}`, err: "not a directory below the output directory"},
+		{route: `/a={team="a"}`, err: "not a directory below the output directory"},
+		{route: `a={team=}`, err: "error parsing selector"},
+	} {
+		route, err := parseRoute(test.route)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want %q", test.route, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: got error: %s", test.route, err)
+			continue
+		}
+
+		if route.Directory != test.directory || route.Matchers.String() != test.matchers {
+			t.Errorf("%s: got directory %q and matchers %v, want %q and %s", test.route, route.Directory, route.Matchers, test.directory, test.matchers)
+		}
+	}
+}
@@ -4,114 +4,240 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"runtime"
 	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/common/model"
-	"github.com/prometheus/prometheus/storage/local"
 	"github.com/prometheus/prometheus/storage/metric"
-	"github.com/prometheus/tsdb"
 	"github.com/prometheus/tsdb/labels"
 )
 
-var stepTime = 1 * time.Hour
-
-func runConvert(ctx context.Context, done chan struct{}, input *local.MemorySeriesStorage, output *tsdb.DB, start time.Time, step time.Duration) {
-	everything, err := metric.NewLabelMatcher(metric.RegexMatch, "__name__", ".+")
+// runConvert converts the input one window at a time. It returns the error
+// of the context if the conversion is interrupted.
+func runConvert(ctx context.Context, input inputStorage, cp *checkpoint, outputDir string, start, end time.Time, step time.Duration, matcherSets []metric.LabelMatchers, relabeler *relabeler, router *router, st *staleness, workers int, limits windowLimits, rep *report, dl *deadLetter) error {
+	maxWidth := int64(step / time.Millisecond)
+	// The blocks of the windows are staged until their step is complete and
+	// merged into one block per step.
+	writer, err := newSampleWriter(outputDir, stagingDirName, router, maxWidth, start.UnixNano()/1e6, end.UnixNano()/1e6, rep, dl)
 	if err != nil {
-		log.Fatalf("Error creating matcher: %s", err)
+		return fmt.Errorf("error creating block writer: %s", err)
 	}
 
-	now := time.Now()
-	fprCache := make(map[string]string)
-
+	width := maxWidth
+	sparse := int64(0)
 	timeStamp := start
-	for ctx.Err() == nil {
-		if now.Before(timeStamp) {
-			break
+	for ctx.Err() == nil && timeStamp.Before(end) {
+		// Windows are aligned to their width, so that they fit into the steps.
+		windowEnd := timeFromMillis(windowStart(timeStamp.UnixNano()/1e6, width) + width)
+		if windowEnd.After(end) {
+			windowEnd = end
+		}
+
+		// The smallest windows are converted regardless of the limits.
+		var windowLimit *windowLimits
+		if limits.canHalve(width) {
+			windowLimit = &limits
+		}
+
+		currentWindow.Set(float64(timeStamp.UnixNano()) / 1e9)
+		windowWidth.Set(float64(width) / 1e3)
+		writer.SetWidth(width)
+		stats, err := convertRange(ctx, timeStamp, windowEnd, input, writer, matcherSets, relabeler, st, workers, windowLimit)
+		if tooLarge, ok := err.(windowTooLargeError); ok {
+			writer.Discard()
+			runtime.GC()
+
+			width /= 2
+			sparse = 0
+			log.Printf("Window at %s is too large (%s), reducing step to %s", timeStamp, tooLarge.reason, time.Duration(width)*time.Millisecond)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error converting range: %s", err)
+		}
+
+		rep.AddBoundaryDuplicates(stats.outside)
+		rep.AddStaleMarkers(stats.markers)
+
+		// The checkpoint is only saved after complete steps, so a partly
+		// converted step is converted again when resuming.
+		next := windowEnd.UnixNano() / 1e6
+		if windowStart(next, maxWidth) == next || !windowEnd.Before(end) {
+			if err := mergeOutputs(outputDir, router != nil, maxWidth); err != nil {
+				return err
+			}
+
+			if err := cp.SaveWindow(windowEnd); err != nil {
+				return fmt.Errorf("error saving checkpoint: %s", err)
+			}
 		}
+		windowsConverted.Inc()
 
-		end := timeStamp.Add(step)
+		timeStamp = windowEnd
 
-		if err := convertRange(ctx, fprCache, timeStamp, end, input, output, everything); err != nil {
-			log.Fatalf("Error converting range: %s", err)
+		// Grow the windows again after sparse windows covering a full step, as
+		// soon as the next window can be aligned to the larger width.
+		sparse += width
+		if !limits.sparse(stats) {
+			sparse = 0
+		}
+		if limits.enabled() && width < maxWidth && sparse >= maxWidth && windowStart(next, 2*width) == next {
+			width *= 2
+			sparse = 0
+			log.Printf("Increasing step to %s", time.Duration(width)*time.Millisecond)
+		}
+		if limits.memoryBudget > 0 {
+			runtime.GC()
 		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-		timeStamp = end
+	if err := cp.Remove(); err != nil {
+		log.Printf("Error removing checkpoint: %s", err)
 	}
 
-	done <- struct{}{}
+	return nil
+}
+
+// samplesInInterval returns the samples inside the interval and the number of
+// samples outside of it. The windows are half-open and do not overlap, so every
+// sample is only converted once, even if the input returns additional samples.
+func samplesInInterval(samples []model.SamplePair, interval metric.Interval) ([]model.SamplePair, int) {
+	first := sort.Search(len(samples), func(i int) bool {
+		return !samples[i].Timestamp.Before(interval.OldestInclusive)
+	})
+	end := sort.Search(len(samples), func(i int) bool {
+		return samples[i].Timestamp.After(interval.NewestInclusive)
+	})
+	if end < first {
+		end = first
+	}
+
+	return samples[first:end], len(samples) - (end - first)
+}
+
+// rangeStats contains the number of series and samples of a converted window,
+// the number of samples outside of the window returned by the input, the
+// number of inserted staleness markers and the largest heap size seen while
+// converting it.
+type rangeStats struct {
+	series  int64
+	samples int64
+	outside int64
+	markers int64
+	heap    uint64
 }
 
-func convertRange(ctx context.Context, fprCache map[string]string, start, end time.Time, input *local.MemorySeriesStorage, output *tsdb.DB, matcher *metric.LabelMatcher) error {
-	modelStart := model.TimeFromUnix(start.Unix())
-	modelEnd := model.TimeFromUnix(end.Unix())
+// convertRange converts the samples between start and end (exclusive). If
+// limits are given and the window exceeds one of them, the conversion is
+// aborted with a windowTooLargeError.
+func convertRange(ctx context.Context, start, end time.Time, input inputStorage, writer sampleWriter, matcherSets []metric.LabelMatchers, relabeler *relabeler, st *staleness, workers int, limits *windowLimits) (rangeStats, error) {
+	var stats rangeStats
+	modelStart := model.TimeFromUnixNano(start.UnixNano())
+	modelEnd := model.TimeFromUnixNano(end.UnixNano())
 
+	// Samples at the end of the window belong to the next window.
 	interval := metric.Interval{
 		OldestInclusive: modelStart,
-		NewestInclusive: modelEnd,
+		NewestInclusive: modelEnd - 1,
 	}
 
-	appender := output.Appender()
+	// The staleness markers depend on the samples around the window.
+	read := interval
+	if st != nil {
+		read = st.readInterval(interval)
+	}
 
-	iteratorSlice, err := input.QueryRange(ctx, modelStart, modelEnd, matcher)
+	iteratorSlice, err := querySelected(ctx, input, read.OldestInclusive, read.NewestInclusive, matcherSets)
 	if err != nil {
-		return fmt.Errorf("error during query: %s", err)
+		return stats, fmt.Errorf("error during query: %s", err)
 	}
 
-	metricCount := 0
-	sampleCount := 0
-
-	for _, iterator := range iteratorSlice {
-		metricCount++
-
-		metric := iterator.Metric().Metric
-		labels := convertMetric(metric)
-		fpr := labels.String()
-
-		samples := iterator.RangeValues(interval)
-		for _, sample := range samples {
-			sampleCount++
-
-			ref, ok := fprCache[fpr]
-			if ok {
-				switch err := appender.AddFast(ref, int64(sample.Timestamp), float64(sample.Value)); err {
-				case nil:
-				case tsdb.ErrNotFound:
-					ok = false
-					log.Printf("Ref not found: %s", fpr)
-				case tsdb.ErrOutOfOrderSample, tsdb.ErrOutOfBounds:
-					log.Printf("Non-fatal error during append: %s", err)
-					continue
-				default:
-					return fmt.Errorf("Error adding samples by ref: %s", err)
-				}
+	// Every iterator is closed by the worker converting it. Iterators of an
+	// aborted window are closed afterwards.
+	closed := make([]bool, len(iteratorSlice))
+	defer func() {
+		for i, iterator := range iteratorSlice {
+			if !closed[i] {
+				iterator.Close()
 			}
+		}
+	}()
 
-			if !ok {
-				ref, err = appender.Add(labels, int64(sample.Timestamp), float64(sample.Value))
-				switch err {
-				case nil:
-				case tsdb.ErrOutOfOrderSample, tsdb.ErrOutOfBounds:
-					log.Printf("Non-fatal error during append: %s", err)
-					continue
-				default:
-					return fmt.Errorf("Error adding samples: %s", err)
-				}
-				if len(ref) > 0 {
-					fprCache[fpr] = ref
-				}
-			}
+	if limits != nil && limits.maxSeries > 0 && len(iteratorSlice) > limits.maxSeries {
+		return stats, windowTooLargeError{fmt.Sprintf("%d series", len(iteratorSlice))}
+	}
+
+	var monitor *heapMonitor
+	if limits != nil && limits.memoryBudget > 0 {
+		monitor = startHeapMonitor(limits.memoryBudget)
+	}
+
+	fps := make([]model.Fingerprint, len(iteratorSlice))
+	for i, iterator := range iteratorSlice {
+		fps[i] = iterator.Metric().Metric.Fingerprint()
+	}
+
+	err = shardByFingerprint(workers, fps, func(i int) error {
+		iterator := iteratorSlice[i]
+		defer func() {
+			iterator.Close()
+			closed[i] = true
+		}()
+
+		if monitor != nil && monitor.Exceeded() {
+			return windowTooLargeError{fmt.Sprintf("heap larger than %s", formatBytes(int64(limits.memoryBudget)))}
+		}
+
+		lset, ok := relabeler.Process(iterator.Metric().Metric)
+		if !ok {
+			return nil
+		}
+
+		samples, outside, markers, err := readSamples(iterator, interval, st)
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(&stats.outside, int64(outside))
+		if len(samples) == 0 && st != nil {
+			// The series only has samples around the window.
+			return nil
+		}
+		atomic.AddInt64(&stats.markers, int64(markers))
+		total := atomic.AddInt64(&stats.samples, int64(len(samples)))
+		if limits != nil && limits.maxSamples > 0 && total > limits.maxSamples {
+			return windowTooLargeError{fmt.Sprintf("more than %d samples", limits.maxSamples)}
+		}
+		atomic.AddInt64(&stats.series, 1)
+
+		return writer.Append(lset, samples)
+	})
+	if err != nil {
+		if monitor != nil {
+			monitor.Stop()
+		}
+		return stats, err
+	}
+
+	if monitor != nil {
+		stats.heap = monitor.Stop()
+		if monitor.Exceeded() {
+			return stats, windowTooLargeError{fmt.Sprintf("heap larger than %s", formatBytes(int64(limits.memoryBudget)))}
 		}
-		iterator.Close()
 	}
 
-	if err := appender.Commit(); err != nil {
-		return fmt.Errorf("error during commit: %s", err)
+	if err := writer.Flush(); err != nil {
+		return stats, fmt.Errorf("error writing block: %s", err)
 	}
+	seriesConverted.Add(float64(stats.series))
 
-	log.Printf("TS: %s Metrics: %d Samples: %d", start, metricCount, sampleCount)
-	return nil
+	log.Printf("TS: %s Metrics: %d Samples: %d", start, stats.series, stats.samples)
+	return stats, nil
 }
 
 func convertMetric(metric model.Metric) labels.Labels {
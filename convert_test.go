@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/tsdb"
+	cfg "github.com/xperimental/tsdb-migrate/config"
+)
+
+// testConversion converts all series of the input into a new directory, which
+// the caller needs to remove.
+func testConversion(t *testing.T, mode string, input testInput, start, end time.Time, step time.Duration, workers int) string {
+	dir, err := ioutil.TempDir("", "tsdb-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every block writer registers the metrics of its compactor.
+	prometheus.DefaultRegisterer = prometheus.NewRegistry()
+
+	ctx := context.Background()
+	matcherSets := []metric.LabelMatchers{{}}
+	rep := newReport("", dir, mode, start, end)
+	cp := newCheckpoint(dir, mode, step, start, end, false)
+
+	switch mode {
+	case cfg.ModeSeries:
+		err = runConvertSeries(ctx, input, cp, dir, start, end, step, 2, 0, matcherSets, labelRules{}, nil, nil, workers, rep, nil)
+	default:
+		var metrics []metric.Metric
+		metrics, err = listSeries(ctx, input, model.TimeFromUnixNano(start.UnixNano()), model.TimeFromUnixNano(end.UnixNano())-1, matcherSets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		relabeler, err := newRelabeler(labelRules{}, metrics)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = runConvert(ctx, input, cp, dir, start, end, step, matcherSets, relabeler, nil, nil, workers, windowLimits{}, rep, nil)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("error converting in %s mode: %s", mode, err)
+	}
+
+	return dir
+}
+
+// testOutput contains the samples by series and the time ranges of the blocks
+// of a converted directory.
+type testOutput struct {
+	samples map[string][]model.SamplePair
+	blocks  [][2]int64
+}
+
+func readTestOutput(t *testing.T, dir string) testOutput {
+	dirs, err := blockDirs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output testOutput
+	for _, d := range dirs {
+		meta, err := readBlockMeta(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output.blocks = append(output.blocks, [2]int64{meta.MinTime, meta.MaxTime})
+	}
+	sort.Slice(output.blocks, func(i, j int) bool { return output.blocks[i][0] < output.blocks[j][0] })
+
+	series, err := outputSeries(dir, 0, int64(model.Latest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, cleanup, err := openOutput(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	querier := db.Querier(0, int64(model.Latest))
+	defer querier.Close()
+
+	output.samples = make(map[string][]model.SamplePair)
+	for _, lset := range series {
+		samples, _, err := outputSamples(querier, lset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output.samples[lset.String()] = samples
+	}
+
+	return output
+}
+
+// testSeriesInput returns series with different scrape intervals and ranges.
+func testSeriesInput() testInput {
+	const minute = model.Time(60000)
+	return testInput{
+		testSeries(model.Metric{model.MetricNameLabel: "up", "job": "a"}, 0, 600*minute, minute, 0),
+		testSeries(model.Metric{model.MetricNameLabel: "up", "job": "b"}, 100*minute, 400*minute, 15000, 1000),
+		testSeries(model.Metric{model.MetricNameLabel: "down", "job": "a"}, 300*minute, 700*minute, 2*minute, 5),
+	}
+}
+
+func TestSeriesModeMatchesTimeMode(t *testing.T) {
+	input := testSeriesInput()
+	start, end := timeFromMillis(30*60000), timeFromMillis(550*60000)
+	step := 2 * time.Hour
+
+	timeDir := testConversion(t, cfg.ModeTime, input, start, end, step, 1)
+	defer os.RemoveAll(timeDir)
+	seriesDir := testConversion(t, cfg.ModeSeries, input, start, end, step, 1)
+	defer os.RemoveAll(seriesDir)
+
+	timeOutput := readTestOutput(t, timeDir)
+	seriesOutput := readTestOutput(t, seriesDir)
+
+	interval := metric.Interval{
+		OldestInclusive: model.TimeFromUnixNano(start.UnixNano()),
+		NewestInclusive: model.TimeFromUnixNano(end.UnixNano()) - 1,
+	}
+	want := make(map[string][]model.SamplePair)
+	for _, s := range input {
+		want[convertMetric(s.metric).String()] = s.RangeValues(interval)
+	}
+
+	if !reflect.DeepEqual(timeOutput.samples, want) {
+		t.Errorf("time mode: got samples %v, want %v", timeOutput.samples, want)
+	}
+	if !reflect.DeepEqual(seriesOutput.samples, want) {
+		t.Errorf("series mode: got samples %v, want %v", seriesOutput.samples, want)
+	}
+	if !reflect.DeepEqual(seriesOutput.blocks, timeOutput.blocks) {
+		t.Errorf("got blocks %v in series mode, %v in time mode", seriesOutput.blocks, timeOutput.blocks)
+	}
+
+	if _, err := os.Stat(seriesDir + "/" + stagingDirName); !os.IsNotExist(err) {
+		t.Errorf("staging directory not removed: %v", err)
+	}
+}
+
+// TestOutputAligned checks that the blocks cover whole steps when the range is
+// not aligned, so that Prometheus 2 can open the output.
+func TestOutputAligned(t *testing.T) {
+	const minute = int64(60000)
+	input := testSeriesInput()
+	step := 2 * time.Hour
+	width := int64(step / time.Millisecond)
+	// The detected end time is just after the newest sample.
+	start, end := timeFromMillis(30*minute), timeFromMillis(550*minute+1)
+
+	for _, mode := range []string{cfg.ModeTime, cfg.ModeSeries} {
+		t.Run(mode, func(t *testing.T) {
+			dir := testConversion(t, mode, input, start, end, step, 1)
+			defer os.RemoveAll(dir)
+
+			output := readTestOutput(t, dir)
+			want := [][2]int64{}
+			for mint := int64(0); mint < 550*minute+1; mint += width {
+				want = append(want, [2]int64{mint, mint + width})
+			}
+			if !reflect.DeepEqual(output.blocks, want) {
+				t.Errorf("got blocks %v, want %v", output.blocks, want)
+			}
+
+			db, err := tsdb.Open(dir, nil, nil, tsdb.DefaultOptions)
+			if err != nil {
+				t.Fatalf("error opening output: %s", err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestWorkersMatchSingleWorker(t *testing.T) {
+	input := testSeriesInput()
+	start, end := timeFromMillis(30*60000), timeFromMillis(550*60000)
+	step := 2 * time.Hour
+
+	for _, mode := range []string{cfg.ModeTime, cfg.ModeSeries} {
+		t.Run(mode, func(t *testing.T) {
+			singleDir := testConversion(t, mode, input, start, end, step, 1)
+			defer os.RemoveAll(singleDir)
+			workersDir := testConversion(t, mode, input, start, end, step, 4)
+			defer os.RemoveAll(workersDir)
+
+			single := readTestOutput(t, singleDir)
+			workers := readTestOutput(t, workersDir)
+			if !reflect.DeepEqual(workers.samples, single.samples) {
+				t.Errorf("got samples %v with 4 workers, %v with 1 worker", workers.samples, single.samples)
+			}
+			if !reflect.DeepEqual(workers.blocks, single.blocks) {
+				t.Errorf("got blocks %v with 4 workers, %v with 1 worker", workers.blocks, single.blocks)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// deadLetter writes the samples which could not be appended to a file with
+// one JSON object per line, so that they can be inspected and imported again.
+type deadLetter struct {
+	mtx    sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	closed bool
+}
+
+// deadLetterSample is one line of the dead-letter file. The value is a string
+// like in the Prometheus API, because JSON can not represent NaN and infinity.
+type deadLetterSample struct {
+	Labels    map[string]string `json:"labels"`
+	Timestamp int64             `json:"timestamp"`
+	Value     string            `json:"value"`
+	Reason    string            `json:"reason"`
+}
+
+// openDeadLetter creates the dead-letter file. An existing file is appended to
+// if resume is set and truncated otherwise.
+func openDeadLetter(path string, resume bool) (*deadLetter, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if resume {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+
+	file, err := os.OpenFile(path, flags, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	return &deadLetter{
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}, nil
+}
+
+// Write adds a rejected sample to the file. Samples are dropped after the file
+// has been closed.
+func (d *deadLetter) Write(lset labels.Labels, sample model.SamplePair, reason string) error {
+	b, err := json.Marshal(deadLetterSample{
+		Labels:    lset.Map(),
+		Timestamp: int64(sample.Timestamp),
+		Value:     strconv.FormatFloat(float64(sample.Value), 'f', -1, 64),
+		Reason:    reason,
+	})
+	if err != nil {
+		return err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if d.closed {
+		return nil
+	}
+
+	if _, err := d.writer.Write(b); err != nil {
+		return err
+	}
+	return d.writer.WriteByte('\n')
+}
+
+// Sync writes the buffered samples to disk.
+func (d *deadLetter) Sync() error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if d.closed {
+		return nil
+	}
+
+	if err := d.writer.Flush(); err != nil {
+		return err
+	}
+	return d.file.Sync()
+}
+
+// Close flushes and closes the file.
+func (d *deadLetter) Close() error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+
+	if err := d.writer.Flush(); err != nil {
+		d.file.Close()
+		return err
+	}
+	return d.file.Close()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+	cfg "github.com/xperimental/tsdb-migrate/config"
+)
+
+// downsampleStorage reduces the resolution of the samples of the input by
+// their age. The samples are grouped into intervals aligned to the resolution
+// and every interval is reduced with the strategy selected by the metric name
+// of the series.
+type downsampleStorage struct {
+	input      inputStorage
+	rules      []cfg.DownsampleRule
+	strategies []cfg.DownsampleStrategy
+	reference  model.Time
+}
+
+// newDownsampleStorage returns a storage reducing the samples of input. The
+// rules need to be sorted by age and the age of a sample is counted back from
+// reference, which is fixed so that the samples are reduced the same way
+// whatever range is converted.
+func newDownsampleStorage(input inputStorage, rules []cfg.DownsampleRule, strategies []cfg.DownsampleStrategy, reference time.Time) *downsampleStorage {
+	return &downsampleStorage{
+		input:      input,
+		rules:      rules,
+		strategies: strategies,
+		reference:  model.TimeFromUnixNano(reference.UnixNano()),
+	}
+}
+
+// QueryRange returns the iterators of the input wrapped to reduce the samples
+// they return.
+func (s *downsampleStorage) QueryRange(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]local.SeriesIterator, error) {
+	iteratorSlice, err := s.input.QueryRange(ctx, from, through, matchers...)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, iterator := range iteratorSlice {
+		iteratorSlice[i] = &downsampleIterator{
+			SeriesIterator: iterator,
+			storage:        s,
+			strategy:       s.strategy(iterator.Metric().Metric),
+		}
+	}
+
+	return iteratorSlice, nil
+}
+
+func (s *downsampleStorage) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
+	return s.input.MetricsForLabelMatchers(ctx, from, through, matcherSets...)
+}
+
+// strategy returns the strategy of the first pattern matching the metric name.
+func (s *downsampleStorage) strategy(m model.Metric) string {
+	name := string(m[model.MetricNameLabel])
+	for _, strategy := range s.strategies {
+		if strategy.Pattern.MatchString(name) {
+			return strategy.Strategy
+		}
+	}
+
+	return cfg.DownsampleLast
+}
+
+// resolution returns the resolution of the rule with the largest age the
+// sample is older than, or zero if the sample is kept.
+func (s *downsampleStorage) resolution(t model.Time) model.Time {
+	age := time.Duration(s.reference-t) * time.Millisecond
+	for i := len(s.rules) - 1; i >= 0; i-- {
+		if age > s.rules[i].Age {
+			return model.Time(s.rules[i].Resolution / time.Millisecond)
+		}
+	}
+
+	return 0
+}
+
+// reduce returns the reduced samples, which are sorted by timestamp.
+func (s *downsampleStorage) reduce(samples []model.SamplePair, strategy string) []model.SamplePair {
+	result := make([]model.SamplePair, 0, len(samples))
+	var bucket []model.SamplePair
+	var bucketResolution, bucketStart model.Time
+	flush := func() {
+		result = append(result, reduceBucket(bucket, strategy)...)
+		bucket = bucket[:0]
+	}
+
+	for _, sample := range samples {
+		resolution := s.resolution(sample.Timestamp)
+		if resolution == 0 {
+			flush()
+			result = append(result, sample)
+			continue
+		}
+
+		start := sample.Timestamp - sample.Timestamp%resolution
+		if resolution != bucketResolution || start != bucketStart {
+			flush()
+		}
+		bucketResolution, bucketStart = resolution, start
+		bucket = append(bucket, sample)
+	}
+	flush()
+
+	return result
+}
+
+// reduceBucket reduces the samples of one interval. All strategies use the
+// timestamp of the last sample, so the reduced samples stay inside the range
+// of the input.
+func reduceBucket(bucket []model.SamplePair, strategy string) []model.SamplePair {
+	if len(bucket) == 0 {
+		return nil
+	}
+	last := bucket[len(bucket)-1]
+
+	switch strategy {
+	case cfg.DownsampleCounter:
+		// Keeping the sample before every reset preserves the increase of the
+		// counter over the interval.
+		var result []model.SamplePair
+		for i := 1; i < len(bucket); i++ {
+			if bucket[i].Value < bucket[i-1].Value {
+				result = append(result, bucket[i-1])
+			}
+		}
+		return append(result, last)
+	case cfg.DownsampleAverage:
+		var sum model.SampleValue
+		for _, sample := range bucket {
+			sum += sample.Value
+		}
+		return []model.SamplePair{{
+			Timestamp: last.Timestamp,
+			Value:     sum / model.SampleValue(len(bucket)),
+		}}
+	default:
+		return []model.SamplePair{last}
+	}
+}
+
+// downsampleIterator reduces the samples returned by RangeValues.
+type downsampleIterator struct {
+	local.SeriesIterator
+	storage  *downsampleStorage
+	strategy string
+}
+
+func (it *downsampleIterator) RangeValues(in metric.Interval) []model.SamplePair {
+	samples := it.SeriesIterator.RangeValues(in)
+	reduced := it.storage.reduce(samples, it.strategy)
+	samplesDownsampled.Add(float64(len(samples) - len(reduced)))
+
+	return reduced
+}
+
+func (it *downsampleIterator) Err() error {
+	return iteratorErr(it.SeriesIterator)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	cfg "github.com/xperimental/tsdb-migrate/config"
+)
+
+func TestReduceBucket(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		bucket   []model.SamplePair
+		strategy string
+		want     []model.SamplePair
+	}{
+		{name: "empty", strategy: cfg.DownsampleLast},
+		{name: "empty counter", strategy: cfg.DownsampleCounter},
+		{name: "empty average", strategy: cfg.DownsampleAverage},
+		{name: "last", bucket: samples(1, 5, 2, 3, 3, 4), strategy: cfg.DownsampleLast, want: samples(3, 4)},
+		{name: "single sample", bucket: samples(1, 5), strategy: cfg.DownsampleLast, want: samples(1, 5)},
+		{name: "counter", bucket: samples(1, 1, 2, 2, 3, 3), strategy: cfg.DownsampleCounter, want: samples(3, 3)},
+		{name: "counter reset", bucket: samples(1, 1, 2, 5, 3, 1, 4, 2), strategy: cfg.DownsampleCounter, want: samples(2, 5, 4, 2)},
+		{name: "counter reset at end", bucket: samples(1, 1, 2, 5, 3, 0), strategy: cfg.DownsampleCounter, want: samples(2, 5, 3, 0)},
+		{name: "counter resets", bucket: samples(1, 3, 2, 1, 3, 4, 4, 2), strategy: cfg.DownsampleCounter, want: samples(1, 3, 3, 4, 4, 2)},
+		{name: "counter constant", bucket: samples(1, 2, 2, 2), strategy: cfg.DownsampleCounter, want: samples(2, 2)},
+		{name: "single counter sample", bucket: samples(1, 5), strategy: cfg.DownsampleCounter, want: samples(1, 5)},
+		{name: "average", bucket: samples(1, 1, 2, 2, 3, 6), strategy: cfg.DownsampleAverage, want: samples(3, 3)},
+		{name: "single average sample", bucket: samples(1, 5), strategy: cfg.DownsampleAverage, want: samples(1, 5)},
+	} {
+		got := reduceBucket(test.bucket, test.strategy)
+		if len(got) != len(test.want) || len(got) > 0 && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDownsampleResolution(t *testing.T) {
+	reference := time.Unix(100*3600, 0)
+	s := newDownsampleStorage(nil, []cfg.DownsampleRule{
+		{Age: time.Hour, Resolution: time.Minute},
+		{Age: 24 * time.Hour, Resolution: time.Hour},
+	}, nil, reference)
+
+	hour := model.Time(3600000)
+	for _, test := range []struct {
+		t    model.Time
+		want model.Time
+	}{
+		{t: 100 * hour, want: 0},
+		{t: 110 * hour, want: 0},
+		{t: 99 * hour, want: 0},
+		{t: 99*hour - 1, want: 60000},
+		{t: 76 * hour, want: 60000},
+		{t: 76*hour - 1, want: hour},
+		{t: 0, want: hour},
+	} {
+		if got := s.resolution(test.t); got != test.want {
+			t.Errorf("%d: got resolution %d, want %d", test.t, got, test.want)
+		}
+	}
+}
+
+func TestDownsampleReduce(t *testing.T) {
+	// Samples before 1h are older than the age of the rule.
+	s := newDownsampleStorage(nil, []cfg.DownsampleRule{
+		{Age: time.Hour, Resolution: time.Minute},
+	}, nil, time.Unix(2*3600, 0))
+
+	input := samples(0, 1, 15000, 2, 30000, 3, 45000, 4, 60000, 5, 75000, 1, 3600000, 7, 3615000, 8)
+	for _, test := range []struct {
+		strategy string
+		want     []model.SamplePair
+	}{
+		{strategy: cfg.DownsampleLast, want: samples(45000, 4, 75000, 1, 3600000, 7, 3615000, 8)},
+		{strategy: cfg.DownsampleCounter, want: samples(45000, 4, 60000, 5, 75000, 1, 3600000, 7, 3615000, 8)},
+		{strategy: cfg.DownsampleAverage, want: samples(45000, 2.5, 75000, 3, 3600000, 7, 3615000, 8)},
+	} {
+		got := s.reduce(input, test.strategy)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.strategy, got, test.want)
+		}
+	}
+
+	if got := s.reduce(nil, cfg.DownsampleLast); len(got) != 0 {
+		t.Errorf("empty input: got %v", got)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	cfg "github.com/xperimental/tsdb-migrate/config"
+)
+
+// Rough sizes used for estimating the resources needed by a conversion. The
+// actual numbers depend on the data, so the estimates are only meant to show
+// whether a configuration is feasible.
+const (
+	chunkBytesPerSample    = 2
+	indexBytesPerSeries    = 100
+	headBytesPerSeries     = 1024
+	headBytesPerSample     = 2
+	decodedBytesPerSample  = 16
+	appendSamplesPerSecond = 1e6
+)
+
+// windowCount contains the number of series and samples in one window.
+type windowCount struct {
+	start      time.Time
+	series     int64
+	samples    int64
+	labelBytes int64
+	maxSamples int64
+}
+
+// runDryRun reads the windows of the conversion like runConvert without
+// writing any output and logs estimates of the resources the conversion needs.
+// Staleness markers are counted as samples. Series mode and window limits are
+// rejected by the configuration.
+func runDryRun(ctx context.Context, done chan error, input inputStorage, config cfg.MigrateConfig, relabeler *relabeler) {
+	started := time.Now()
+	width := int64(config.StepTime / time.Millisecond)
+	st := newStaleness(config.StaleMarkers, config.StaleGapFactor)
+
+	var windows []windowCount
+	timeStamp := config.StartTime
+	for ctx.Err() == nil && timeStamp.Before(config.EndTime) {
+		windowEnd := timeFromMillis(windowStart(timeStamp.UnixNano()/1e6, width) + width)
+		if windowEnd.After(config.EndTime) {
+			windowEnd = config.EndTime
+		}
+
+		count, err := countRange(ctx, timeStamp, windowEnd, input, config.Matchers, relabeler, st, config.Workers)
+		if err != nil {
+			done <- fmt.Errorf("error counting range: %s", err)
+			return
+		}
+		windows = append(windows, count)
+
+		log.Printf("TS: %s Metrics: %d Samples: %d Size: ~%s Memory: ~%s", timeStamp, count.series, count.samples,
+			formatBytes(count.outputBytes()), formatBytes(count.memoryBytes(config.Workers)))
+
+		timeStamp = windowEnd
+	}
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	var series, samples, size, memory int64
+	for _, w := range windows {
+		samples += w.samples
+		size += w.outputBytes()
+		if m := w.memoryBytes(config.Workers); m > memory {
+			memory = m
+		}
+		if w.series > series {
+			series = w.series
+		}
+	}
+
+	readTime := time.Since(started)
+	appendTime := time.Duration(float64(samples) / appendSamplesPerSecond / float64(config.Workers) * float64(time.Second))
+
+	log.Printf("Dry run: %d windows with up to %d series and %d samples in total.", len(windows), series, samples)
+	log.Printf("Estimated output size: %s", formatBytes(size))
+	log.Printf("Estimated peak memory: %s", formatBytes(memory))
+	log.Printf("Estimated duration: %s (reading took %s)", (readTime + appendTime).Round(time.Second), readTime.Round(time.Millisecond))
+
+	done <- nil
+}
+
+// countRange counts the series and samples which would be converted between
+// start and end (exclusive), including the inserted staleness markers.
+func countRange(ctx context.Context, start, end time.Time, input inputStorage, matcherSets []metric.LabelMatchers, relabeler *relabeler, st *staleness, workers int) (windowCount, error) {
+	count := windowCount{start: start}
+	interval := metric.Interval{
+		OldestInclusive: model.TimeFromUnixNano(start.UnixNano()),
+		NewestInclusive: model.TimeFromUnixNano(end.UnixNano()) - 1,
+	}
+
+	read := interval
+	if st != nil {
+		read = st.readInterval(interval)
+	}
+
+	iteratorSlice, err := querySelected(ctx, input, read.OldestInclusive, read.NewestInclusive, matcherSets)
+	if err != nil {
+		return count, fmt.Errorf("error during query: %s", err)
+	}
+
+	fps := make([]model.Fingerprint, len(iteratorSlice))
+	for i, iterator := range iteratorSlice {
+		fps[i] = iterator.Metric().Metric.Fingerprint()
+	}
+
+	err = shardByFingerprint(workers, fps, func(i int) error {
+		iterator := iteratorSlice[i]
+		defer iterator.Close()
+
+		lset, ok := relabeler.Process(iterator.Metric().Metric)
+		if !ok {
+			return nil
+		}
+
+		converted, _, _, err := readSamples(iterator, interval, st)
+		if err != nil {
+			return err
+		}
+		samples := int64(len(converted))
+		if samples == 0 {
+			return nil
+		}
+
+		labelBytes := 0
+		for _, l := range lset {
+			labelBytes += len(l.Name) + len(l.Value)
+		}
+
+		atomic.AddInt64(&count.series, 1)
+		atomic.AddInt64(&count.samples, samples)
+		atomic.AddInt64(&count.labelBytes, int64(labelBytes))
+		for {
+			max := atomic.LoadInt64(&count.maxSamples)
+			if samples <= max || atomic.CompareAndSwapInt64(&count.maxSamples, max, samples) {
+				break
+			}
+		}
+		return nil
+	})
+
+	return count, err
+}
+
+// outputBytes estimates the size of the block of the window.
+func (c windowCount) outputBytes() int64 {
+	return int64(float64(c.samples)*chunkBytesPerSample) + c.series*indexBytesPerSeries + c.labelBytes
+}
+
+// memoryBytes estimates the memory needed for converting the window in time
+// mode: the head containing all series of the window and the decoded samples
+// of the series being converted.
+func (c windowCount) memoryBytes(workers int) int64 {
+	head := c.series*headBytesPerSeries + c.labelBytes + c.samples*headBytesPerSample
+	return head + int64(workers)*c.maxSamples*decodedBytesPerSample
+}
+
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
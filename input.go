@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+	cfg "github.com/xperimental/tsdb-migrate/config"
+	"github.com/xperimental/tsdb-migrate/reader"
+)
+
+// inputStorage contains the methods used for reading the 1.x storage. It is
+// implemented by the storage engine and by the read-only reader.
+type inputStorage interface {
+	QueryRange(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]local.SeriesIterator, error)
+	MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error)
+}
+
+// querySelected returns iterators for all series matching any of the matcher
+// sets. Series matching more than one set are only returned once.
+func querySelected(ctx context.Context, input inputStorage, from, through model.Time, matcherSets []metric.LabelMatchers) ([]local.SeriesIterator, error) {
+	var result []local.SeriesIterator
+	seen := make(map[model.Fingerprint]bool)
+	for _, matchers := range matcherSets {
+		iteratorSlice, err := input.QueryRange(ctx, from, through, matchers...)
+		if err != nil {
+			for _, iterator := range result {
+				iterator.Close()
+			}
+			return nil, err
+		}
+
+		for _, iterator := range iteratorSlice {
+			fp := iterator.Metric().Metric.Fingerprint()
+			if seen[fp] {
+				iterator.Close()
+				continue
+			}
+			seen[fp] = true
+			result = append(result, iterator)
+		}
+	}
+
+	return result, nil
+}
+
+// querySeries returns an iterator for the series with exactly the labels of m
+// or nil if the series has no samples between from and through. The matchers
+// of m also select series with additional labels, which are skipped.
+func querySeries(ctx context.Context, input inputStorage, from, through model.Time, m model.Metric) (local.SeriesIterator, error) {
+	iteratorSlice, err := input.QueryRange(ctx, from, through, matchersForMetric(m)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var result local.SeriesIterator
+	for _, iterator := range iteratorSlice {
+		if result == nil && iterator.Metric().Metric.Equal(m) {
+			result = iterator
+			continue
+		}
+		iterator.Close()
+	}
+
+	return result, nil
+}
+
+// iteratorErr returns the error of iterators which can fail while reading
+// samples. The iterators of the storage engine do not return errors.
+func iteratorErr(iterator local.SeriesIterator) error {
+	if it, ok := iterator.(interface {
+		Err() error
+	}); ok {
+		return it.Err()
+	}
+
+	return nil
+}
+
+func matchersForMetric(m model.Metric) []*metric.LabelMatcher {
+	matchers := make([]*metric.LabelMatcher, 0, len(m))
+	for name, value := range m {
+		matcher, err := metric.NewLabelMatcher(metric.Equal, name, value)
+		if err != nil {
+			// Equality matchers can not fail.
+			panic(err)
+		}
+		matchers = append(matchers, matcher)
+	}
+
+	return matchers
+}
+
+// listSeries returns the series matching any of the matcher sets sorted by
+// fingerprint.
+func listSeries(ctx context.Context, input inputStorage, from, through model.Time, matcherSets []metric.LabelMatchers) ([]metric.Metric, error) {
+	metrics, err := input.MetricsForLabelMatchers(ctx, from, through, matcherSets...)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Metric.Fingerprint() < metrics[j].Metric.Fingerprint()
+	})
+
+	return metrics, nil
+}
+
+// allSeriesMatchers returns matcher sets selecting every series of the inputs.
+// The direct reader returns all series for an empty set. The storage engine
+// needs a matcher which does not match the empty value, so there is one set
+// for the series with a metric name and, for the series without one, one set
+// per label name needed to select all of them. Every set unarchives the series
+// it selects, so the label names are chosen from the index of the readers
+// instead of using all of them. Series without any labels can not be selected
+// by the engine and are returned as skipped.
+func allSeriesMatchers(readers []*reader.Reader, readerName string) ([]metric.LabelMatchers, []skippedSeries, error) {
+	if readerName == cfg.ReaderDirect {
+		return []metric.LabelMatchers{{}}, nil, nil
+	}
+
+	named := false
+	unnamedNames := make(map[model.LabelName]bool)
+	var skipped []skippedSeries
+	for _, r := range readers {
+		for _, fp := range r.Fingerprints() {
+			s, _ := r.Series(fp)
+			switch {
+			case len(s.Metric) == 0:
+				// Series without labels have the same fingerprint in every
+				// input, so they are only skipped once.
+				if len(skipped) == 0 {
+					log.Printf("Skipping series %s: the storage engine can not read series without labels", s.Metric)
+					skipped = append(skipped, skippedSeries{
+						Labels: s.Metric.String(),
+						Reason: "series has no labels",
+					})
+				}
+			case s.Metric[model.MetricNameLabel] != "":
+				named = true
+			default:
+				if name, ok := unnamedLabel(s.Metric, unnamedNames); ok {
+					unnamedNames[name] = true
+				}
+			}
+		}
+	}
+
+	var matcherSets []metric.LabelMatchers
+	if named {
+		present, err := metric.NewLabelMatcher(metric.RegexMatch, model.MetricNameLabel, ".+")
+		if err != nil {
+			return nil, nil, err
+		}
+		matcherSets = append(matcherSets, metric.LabelMatchers{present})
+	}
+
+	if len(unnamedNames) == 0 {
+		return matcherSets, skipped, nil
+	}
+
+	unnamed, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	names := make(model.LabelNames, 0, len(unnamedNames))
+	for name := range unnamedNames {
+		names = append(names, name)
+	}
+	sort.Sort(names)
+
+	for _, name := range names {
+		present, err := metric.NewLabelMatcher(metric.RegexMatch, name, ".+")
+		if err != nil {
+			return nil, nil, err
+		}
+		matcherSets = append(matcherSets, metric.LabelMatchers{present, unnamed})
+	}
+
+	return matcherSets, skipped, nil
+}
+
+// unnamedLabel returns the smallest label name of a series without a metric
+// name, or false if the series already has one of the selected names.
+func unnamedLabel(m model.Metric, selected map[model.LabelName]bool) (model.LabelName, bool) {
+	names := make(model.LabelNames, 0, len(m))
+	for name := range m {
+		if selected[name] {
+			return "", false
+		}
+		names = append(names, name)
+	}
+	sort.Sort(names)
+
+	return names[0], true
+}
+
+func openStorage(dir string, retention time.Duration) *local.MemorySeriesStorage {
+	storageOpts := &local.MemorySeriesStorageOptions{
+		TargetHeapSize:             2 * 1024 * 1024 * 1024,
+		PersistenceStoragePath:     dir,
+		PersistenceRetentionPeriod: retention,
+		HeadChunkTimeout:           5 * time.Minute,
+		CheckpointInterval:         24 * time.Hour,
+		CheckpointDirtySeriesLimit: 5000,
+		Dirty:                      false,
+		PedanticChecks:             false,
+		SyncStrategy:               local.Adaptive,
+		MinShrinkRatio:             0.1,
+		NumMutexes:                 4096,
+	}
+
+	log.Printf("Opening local storage: %s", dir)
+	localStorage := local.NewMemorySeriesStorage(storageOpts)
+	if err := localStorage.Start(); err != nil {
+		log.Fatalf("Error starting local storage: %s", err)
+	}
+
+	return localStorage
+}
+
+func openReader(dir string) *reader.Reader {
+	log.Printf("Reading local storage: %s", dir)
+	r, err := reader.Open(dir)
+	if err != nil {
+		log.Fatalf("Error reading local storage: %s", err)
+	}
+
+	if r.Dirty() {
+		log.Printf("Warning: local storage was not shut down cleanly, some data might be inconsistent.")
+	}
+	log.Printf("Found %d series (%d remapped fingerprints).", len(r.Fingerprints()), r.Mappings())
+
+	return r
+}
+
+// detectTimeRange sets the start and end time which have not been configured
+// to the range of the samples in the storage.
+func detectTimeRange(readers []*reader.Reader, config *cfg.MigrateConfig) {
+	first, last := model.Latest, model.Earliest
+	for _, r := range readers {
+		rFirst, rLast, err := r.TimeRange()
+		if err != nil {
+			log.Fatalf("Error detecting time range: %s", err)
+		}
+		log.Printf("Detected time range: %s - %s (%d series)", rFirst.Time().UTC(), rLast.Time().UTC(), len(r.Fingerprints()))
+
+		if rFirst.Before(first) {
+			first = rFirst
+		}
+		if rLast.After(last) {
+			last = rLast
+		}
+	}
+
+	if config.StartTime.IsZero() {
+		config.StartTime = first.Time()
+	}
+
+	if config.EndTime.IsZero() {
+		config.EndTime = (last + 1).Time()
+	}
+
+	if !config.StartTime.Before(config.EndTime) {
+		log.Fatalf("Start time %s is not before end time %s", config.StartTime, config.EndTime)
+	}
+	log.Printf("Converting range: %s - %s", config.StartTime.UTC(), config.EndTime.UTC())
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+	cfg "github.com/xperimental/tsdb-migrate/config"
+	"github.com/xperimental/tsdb-migrate/reader"
+)
+
+// testInput is an input storage with the series of the iterators. Like the
+// storage engine, it only returns series with samples in the queried range.
+type testInput []*sliceIterator
+
+func (in testInput) QueryRange(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]local.SeriesIterator, error) {
+	var result []local.SeriesIterator
+	for _, s := range in {
+		if matchesMetric(s.metric, matchers) && len(s.RangeValues(metric.Interval{OldestInclusive: from, NewestInclusive: through})) > 0 {
+			result = append(result, &sliceIterator{metric: s.metric, samples: s.samples})
+		}
+	}
+	return result, nil
+}
+
+func (in testInput) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
+	var result []metric.Metric
+	for _, s := range in {
+		if len(s.RangeValues(metric.Interval{OldestInclusive: from, NewestInclusive: through})) == 0 {
+			continue
+		}
+
+		for _, matchers := range matcherSets {
+			if matchesMetric(s.metric, matchers) {
+				result = append(result, metric.Metric{Metric: s.metric})
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+func matchesMetric(m model.Metric, matchers metric.LabelMatchers) bool {
+	for _, matcher := range matchers {
+		if !matcher.Match(m[matcher.Name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// testSeries returns a series with a sample every interval from start up to
+// end (exclusive). The values count up from offset.
+func testSeries(m model.Metric, start, end, interval model.Time, offset float64) *sliceIterator {
+	it := &sliceIterator{metric: m}
+	for t := start; t < end; t += interval {
+		it.samples = append(it.samples, model.SamplePair{
+			Timestamp: t,
+			Value:     model.SampleValue(offset + float64(len(it.samples))),
+		})
+	}
+	return it
+}
+
+func TestAllSeriesMatchers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsdb-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	series := []model.Metric{
+		{model.MetricNameLabel: "up", "job": "a", "env": "prod"},
+		{model.MetricNameLabel: "down", "zone": "x"},
+		{"job": "a"},
+		{"job": "b", "instance": "x"},
+		{"instance": "y"},
+	}
+
+	storage := openStorage(dir, 24*time.Hour)
+	now := model.Now()
+	for _, m := range series {
+		if err := storage.Append(&model.Sample{Metric: m, Timestamp: now, Value: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storage.WaitForIndexing()
+	if err := storage.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := reader.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matcherSets, skipped, err := allSeriesMatchers([]*reader.Reader{r}, cfg.ReaderStorage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 0 {
+		t.Errorf("got skipped series %v, want none", skipped)
+	}
+
+	// One set for the series with a metric name, at most two for the others.
+	if len(matcherSets) < 2 || len(matcherSets) > 3 {
+		t.Errorf("got %d matcher sets %v, want 2 or 3", len(matcherSets), matcherSets)
+	}
+	for _, matchers := range matcherSets {
+		for _, m := range matchers {
+			if m.Name == "env" || m.Name == "zone" {
+				t.Errorf("got matcher set %v for a label of the series with a metric name", matchers)
+			}
+		}
+	}
+
+	for _, m := range series {
+		if !matchesAny(convertMetric(m), matcherSets) {
+			t.Errorf("series %s is not selected by %v", m, matcherSets)
+		}
+	}
+}
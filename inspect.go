@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/xperimental/tsdb-migrate/reader"
+)
+
+var encodingNames = map[chunk.Encoding]string{
+	chunk.Delta:       "delta",
+	chunk.DoubleDelta: "double-delta",
+	chunk.Varbit:      "varbit",
+}
+
+// nameCount is the number of series using a metric or label name.
+type nameCount struct {
+	name  string
+	count int
+}
+
+// runInspect writes a summary of the input storage to out.
+func runInspect(r *reader.Reader, dir string, topN int, out io.Writer) error {
+	stats, err := r.Stats()
+	if err != nil {
+		return fmt.Errorf("error reading statistics: %s", err)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Directory:\t%s\n", dir)
+	fmt.Fprintf(w, "Version:\t%s\n", r.Version())
+	fmt.Fprintf(w, "Dirty:\t%t\n", r.Dirty())
+	fmt.Fprintf(w, "Series:\t%d (%d in memory, %d archived)\n", len(r.Fingerprints()), stats.MemorySeries, stats.ArchivedSeries)
+	fmt.Fprintf(w, "Remapped fingerprints:\t%d\n", r.Mappings())
+
+	if first, last, err := r.TimeRange(); err == nil {
+		fmt.Fprintf(w, "Time range:\t%s - %s\n", first.Time().UTC(), last.Time().UTC())
+	}
+
+	totalChunks := 0
+	for _, count := range stats.Chunks {
+		totalChunks += count
+	}
+	fmt.Fprintf(w, "Chunks:\t%d\n", totalChunks)
+	for _, encoding := range []chunk.Encoding{chunk.Delta, chunk.DoubleDelta, chunk.Varbit} {
+		fmt.Fprintf(w, "  %s:\t%d\n", encodingNames[encoding], stats.Chunks[encoding])
+	}
+
+	metricNames := make(map[string]int)
+	labelNames := make(map[string]int)
+	for _, fp := range r.Fingerprints() {
+		s, _ := r.Series(fp)
+		if name, ok := s.Metric[model.MetricNameLabel]; ok {
+			metricNames[string(name)]++
+		}
+		for name := range s.Metric {
+			labelNames[string(name)]++
+		}
+	}
+
+	fmt.Fprintf(w, "\nTop %d metric names by series:\n", topN)
+	for _, n := range topNames(metricNames, topN) {
+		fmt.Fprintf(w, "  %s\t%d\n", n.name, n.count)
+	}
+
+	fmt.Fprintf(w, "\nTop %d label names by series:\n", topN)
+	for _, n := range topNames(labelNames, topN) {
+		fmt.Fprintf(w, "  %s\t%d\n", n.name, n.count)
+	}
+
+	prefixes := make([]string, 0, len(stats.DirSizes))
+	var totalSize int64
+	for prefix, size := range stats.DirSizes {
+		prefixes = append(prefixes, prefix)
+		totalSize += size
+	}
+	sort.Strings(prefixes)
+
+	fmt.Fprintf(w, "\nSize of series files per fingerprint prefix (total %d bytes):\n", totalSize)
+	for _, prefix := range prefixes {
+		fmt.Fprintf(w, "  %s\t%d\n", prefix, stats.DirSizes[prefix])
+	}
+
+	return w.Flush()
+}
+
+// topNames returns the n names with the highest counts.
+func topNames(counts map[string]int, n int) []nameCount {
+	result := make([]nameCount, 0, len(counts))
+	for name, count := range counts {
+		result = append(result, nameCount{name, count})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].count != result[j].count {
+			return result[i].count > result[j].count
+		}
+		return result[i].name < result[j].name
+	})
+
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
@@ -2,80 +2,287 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/prometheus/prometheus/storage/local"
-	"github.com/prometheus/tsdb"
-	"github.com/xperimental/tsdb-migrate/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	cfg "github.com/xperimental/tsdb-migrate/config"
+	"github.com/xperimental/tsdb-migrate/reader"
 )
 
 func main() {
-	config, err := config.ParseFlags()
+	config, err := cfg.ParseFlags()
 	if err != nil {
 		log.Fatalf("Error in flags: %s", err)
 	}
 
-	storageOpts := &local.MemorySeriesStorageOptions{
-		TargetHeapSize:             2 * 1024 * 1024 * 1024,
-		PersistenceStoragePath:     config.InputDirectory,
-		PersistenceRetentionPeriod: config.RetentionTime,
-		HeadChunkTimeout:           5 * time.Minute,
-		CheckpointInterval:         24 * time.Hour,
-		CheckpointDirtySeriesLimit: 5000,
-		Dirty:          false,
-		PedanticChecks: false,
-		SyncStrategy:   local.Adaptive,
-		MinShrinkRatio: 0.1,
-		NumMutexes:     4096,
+	switch config.Command {
+	case cfg.CommandInspect:
+		dir := config.InputDirectories[0]
+		if err := runInspect(openReader(dir), dir, config.TopN, os.Stdout); err != nil {
+			log.Fatalf("Error inspecting input: %s", err)
+		}
+		return
+	case cfg.CommandInspectBlocks:
+		if err := runInspectBlocks(config.OutputDirectory, config.RetentionTime, os.Stdout); err != nil {
+			log.Fatalf("Error inspecting output: %s", err)
+		}
+		return
+	case cfg.CommandReverse:
+		if err := runReverse(config); err != nil {
+			log.Fatalf("Error copying output to input: %s", err)
+		}
+		return
+	}
+
+	// The time range and the label names are detected before the storage
+	// engine is started, because the engine locks the index databases.
+	var readers []*reader.Reader
+	if config.Reader == cfg.ReaderDirect || config.StartTime.IsZero() || config.EndTime.IsZero() || len(config.Matchers) == 0 {
+		for _, dir := range config.InputDirectories {
+			readers = append(readers, openReader(dir))
+		}
+	}
+
+	if config.StartTime.IsZero() || config.EndTime.IsZero() {
+		detectTimeRange(readers, &config)
 	}
 
-	log.Printf("Opening local storage: %s", config.InputDirectory)
-	localStorage := local.NewMemorySeriesStorage(storageOpts)
-	if err := localStorage.Start(); err != nil {
-		log.Fatalf("Error starting local storage: %s", err)
+	var unreadable []skippedSeries
+	if len(config.Matchers) == 0 {
+		config.Matchers, unreadable, err = allSeriesMatchers(readers, config.Reader)
+		if err != nil {
+			log.Fatalf("Error creating matchers: %s", err)
+		}
 	}
-	defer func() {
-		log.Println("Stopping local storage...")
-		if err := localStorage.Stop(); err != nil {
-			log.Printf("Error stopping local storage: %s", err)
+
+	var inputs []inputStorage
+	var stopInputs []func()
+	switch config.Reader {
+	case cfg.ReaderDirect:
+		for _, r := range readers {
+			inputs = append(inputs, r)
 		}
-	}()
+	default:
+		readers = nil
 
-	tsdbOpts := &tsdb.Options{
-		WALFlushInterval:  5 * time.Minute,
-		RetentionDuration: uint64(config.RetentionTime.Seconds() * 1000),
-		BlockRanges:       tsdb.ExponentialBlockRanges(int64(2*time.Hour)/1e6, 3, 5),
-		NoLockfile:        false,
+		for i, dir := range config.InputDirectories {
+			dir := dir
+			localStorage := openStorage(dir, config.RetentionTime)
+			stopInputs = append(stopInputs, func() {
+				log.Printf("Stopping local storage %s...", dir)
+				if err := localStorage.Stop(); err != nil {
+					log.Printf("Error stopping local storage: %s", err)
+				}
+			})
+			// The metrics of several storage engines have the same names, so
+			// only the first engine is exported.
+			if i == 0 {
+				prometheus.MustRegister(localStorage)
+			}
+			inputs = append(inputs, localStorage)
+		}
+	}
+	stopInput := func() {
+		for _, stop := range stopInputs {
+			stop()
+		}
 	}
 
-	log.Printf("Opening TSDB: %s", config.OutputDirectory)
-	db, err := tsdb.Open(config.OutputDirectory, nil, nil, tsdbOpts)
-	if err != nil {
-		log.Fatalf("Error creating tsdb: %s", err)
+	input := inputs[0]
+	if len(inputs) > 1 {
+		log.Printf("Merging %d inputs with policy %s and tolerance %s.", len(inputs), config.DedupePolicy, config.DedupeTolerance)
+		input = newMergeStorage(inputs, config.DedupePolicy, config.DedupeTolerance)
+	}
+
+	if len(config.Downsampling) > 0 {
+		if config.Resume && config.Command == cfg.CommandMigrate {
+			// The samples converted before the interruption have been reduced
+			// counting back from the reference of the checkpoint.
+			if cp, err := readCheckpoint(config.OutputDirectory); err == nil && !cp.DownsampleRef.IsZero() && !cp.DownsampleRef.Equal(config.DownsampleRef) {
+				log.Printf("Using the downsampling reference of the checkpoint: %s", cp.DownsampleRef.UTC().Format(time.RFC3339))
+				config.DownsampleRef = cp.DownsampleRef
+			}
+		}
+		for _, rule := range config.Downsampling {
+			log.Printf("Downsampling samples older than %s to one sample per %s.", model.Duration(rule.Age), model.Duration(rule.Resolution))
+		}
+		log.Printf("Counting the age of samples back from %s.", config.DownsampleRef.Format(time.RFC3339))
+		input = newDownsampleStorage(input, config.Downsampling, config.Strategies, config.DownsampleRef)
+	}
+
+	if config.ListenAddress != "" {
+		go serveMetrics(config.ListenAddress)
 	}
-	defer func() {
-		log.Println("Closing TSDB...")
-		db.Close()
-	}()
 
 	ctx, cancel := context.WithCancel(context.Background())
 
-	done := make(chan struct{})
-	go runConvert(ctx, done, localStorage, db, config.StartTime, config.StepTime)
+	rep := newReport(strings.Join(config.InputDirectories, ","), config.OutputDirectory, config.Mode, config.StartTime, config.EndTime)
+	rep.AddSkipped(unreadable...)
+	if len(config.ExternalLabels) > 0 {
+		rep.ExternalLabels = config.ExternalLabels
+		rep.LabelConflict = config.LabelConflict
+	}
+	closeDeadLetter := func() {}
+	done := make(chan error, 1)
+	switch {
+	case config.Command == cfg.CommandVerify:
+		go func() {
+			done <- runVerify(ctx, input, config.OutputDirectory, config.StartTime, config.EndTime, config.Matchers, labelRulesFromConfig(config), newRouter(config))
+		}()
+	case config.DryRun:
+		go func() {
+			relabeler, err := rangeRelabeler(ctx, input, config)
+			if err != nil {
+				done <- err
+				return
+			}
 
-	term := make(chan os.Signal)
+			runDryRun(ctx, done, input, config, relabeler)
+		}()
+	default:
+		var dl *deadLetter
+		if config.DeadLetterFile != "" {
+			dl, err = openDeadLetter(config.DeadLetterFile, config.Resume)
+			if err != nil {
+				done <- fmt.Errorf("error opening dead-letter file: %s", err)
+				break
+			}
+			closeDeadLetter = func() {
+				if err := dl.Close(); err != nil {
+					log.Printf("Error closing dead-letter file: %s", err)
+				}
+			}
+		}
+
+		go func() {
+			done <- runMigration(ctx, input, config, rep, dl)
+		}()
+	}
+
+	term := make(chan os.Signal, 1)
 	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 
+	exitCode := 0
+	status := statusCompleted
+	var runErr error
 	select {
-	case <-done:
+	case runErr = <-done:
+		if runErr != nil {
+			log.Printf("Error: %s", runErr)
+			exitCode = 1
+			status = statusFailed
+		}
 	case <-term:
 		log.Printf("Caught interrupt. Exiting...")
+		exitCode = 1
+		status = statusInterrupted
+	}
+
+	if config.ReportFile != "" && config.Command == cfg.CommandMigrate && !config.DryRun {
+		if err := rep.Write(config.ReportFile, status, runErr); err != nil {
+			log.Printf("Error writing report: %s", err)
+		}
 	}
 
 	log.Printf("Shutting down...")
 	cancel()
+	closeDeadLetter()
+	stopInput()
+	os.Exit(exitCode)
+}
+
+// runMigration converts the input with the configured mode, continuing from
+// the checkpoint when resuming.
+func runMigration(ctx context.Context, input inputStorage, config cfg.MigrateConfig, rep *report, dl *deadLetter) error {
+	cp := newCheckpoint(config.OutputDirectory, config.Mode, config.StepTime, config.StartTime, config.EndTime, config.Split())
+	if len(config.Downsampling) > 0 {
+		cp.DownsampleRef = config.DownsampleRef
+	}
+	if config.Resume {
+		loaded, err := loadCheckpoint(config.OutputDirectory, config.Mode, config.StepTime, config.Split())
+		switch {
+		case os.IsNotExist(err):
+			log.Println("No checkpoint found. Starting from the beginning.")
+		case err != nil:
+			return fmt.Errorf("error loading checkpoint: %s", err)
+		case loaded.DownsampleRef.IsZero() != (len(config.Downsampling) == 0):
+			return errors.New("checkpoint was created with different downsampling")
+		default:
+			cp = loaded
+			// Relative times would be evaluated again, so the range is
+			// taken from the checkpoint.
+			if !cp.Start.Equal(config.StartTime) || !cp.End.Equal(config.EndTime) {
+				log.Printf("Using the time range of the checkpoint: %s - %s", cp.Start.UTC(), cp.End.UTC())
+			}
+			config.StartTime, config.EndTime = cp.Start, cp.End
+			rep.Start, rep.End = cp.Start, cp.End
+		}
+	}
+
+	start := config.StartTime
+	switch {
+	case !cp.WindowEnd.IsZero():
+		log.Printf("Resuming after window ending at %s", cp.WindowEnd)
+		start = cp.WindowEnd
+		rep.Resumed = true
+	case cp.LastFingerprint != "":
+		log.Printf("Resuming after series %s", cp.LastFingerprint)
+		rep.Resumed = true
+	}
+
+	// The blocks cover whole steps, also at the start and end of the range.
+	mint, maxt := alignRange(start.UnixNano()/1e6, config.EndTime.UnixNano()/1e6, int64(config.StepTime/time.Millisecond))
+	if err := checkOverlap(config.OutputDirectory, mint, maxt); err != nil {
+		return fmt.Errorf("error checking output: %s", err)
+	}
+
+	if config.Split() {
+		log.Printf("Splitting the series into directories below: %s", config.OutputDirectory)
+	} else {
+		log.Printf("Writing blocks to: %s", config.OutputDirectory)
+	}
+
+	switch config.Mode {
+	case cfg.ModeSeries:
+		return runConvertSeries(ctx, input, cp, config.OutputDirectory, config.StartTime, config.EndTime, config.StepTime, config.BatchSize, config.MaxBatchSamples, config.Matchers, labelRulesFromConfig(config), newRouter(config), newStaleness(config.StaleMarkers, config.StaleGapFactor), config.Workers, rep, dl)
+	default:
+		relabeler, err := rangeRelabeler(ctx, input, config)
+		if err != nil {
+			return err
+		}
+		rep.AddSkipped(relabeler.Skipped()...)
+
+		limits := windowLimits{
+			minWidth:     int64(config.MinStepTime / time.Millisecond),
+			maxSeries:    config.MaxSeries,
+			maxSamples:   config.MaxSamples,
+			memoryBudget: config.MemoryBudget,
+		}
+
+		return runConvert(ctx, input, cp, config.OutputDirectory, start, config.EndTime, config.StepTime, config.Matchers, relabeler, newRouter(config), newStaleness(config.StaleMarkers, config.StaleGapFactor), config.Workers, limits, rep, dl)
+	}
+}
+
+// rangeRelabeler checks the series over the complete range, so that every
+// window and a resumed conversion reject the same series.
+func rangeRelabeler(ctx context.Context, input inputStorage, config cfg.MigrateConfig) (*relabeler, error) {
+	series, err := listSeries(ctx, input, model.TimeFromUnixNano(config.StartTime.UnixNano()), model.TimeFromUnixNano(config.EndTime.UnixNano())-1, config.Matchers)
+	if err != nil {
+		return nil, fmt.Errorf("error listing series: %s", err)
+	}
+
+	relabeler, err := newRelabeler(labelRulesFromConfig(config), series)
+	if err != nil {
+		return nil, fmt.Errorf("error applying labels: %s", err)
+	}
+
+	return relabeler, nil
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+	cfg "github.com/xperimental/tsdb-migrate/config"
+)
+
+// mergeStorage merges the series of several inputs, for example of the
+// replicas of an HA pair. The samples of a series found in more than one input
+// are deduplicated according to the policy. The order of the inputs is the
+// order of preference.
+type mergeStorage struct {
+	inputs    []inputStorage
+	policy    string
+	tolerance model.Time
+}
+
+func newMergeStorage(inputs []inputStorage, policy string, tolerance time.Duration) *mergeStorage {
+	return &mergeStorage{
+		inputs:    inputs,
+		policy:    policy,
+		tolerance: model.Time(tolerance / time.Millisecond),
+	}
+}
+
+// QueryRange returns one iterator per series, which merges the samples of the
+// series in all inputs.
+func (s *mergeStorage) QueryRange(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]local.SeriesIterator, error) {
+	var merged []*mergeIterator
+	byFingerprint := make(map[model.Fingerprint]*mergeIterator)
+	for _, input := range s.inputs {
+		iteratorSlice, err := input.QueryRange(ctx, from, through, matchers...)
+		if err != nil {
+			for _, it := range merged {
+				it.Close()
+			}
+			return nil, err
+		}
+
+		for _, iterator := range iteratorSlice {
+			fp := iterator.Metric().Metric.Fingerprint()
+			it, ok := byFingerprint[fp]
+			if !ok {
+				it = &mergeIterator{storage: s}
+				byFingerprint[fp] = it
+				merged = append(merged, it)
+			}
+			it.iterators = append(it.iterators, iterator)
+		}
+	}
+
+	result := make([]local.SeriesIterator, len(merged))
+	for i, it := range merged {
+		result[i] = it
+	}
+	return result, nil
+}
+
+// MetricsForLabelMatchers returns the series of all inputs. Series found in
+// more than one input are only returned once.
+func (s *mergeStorage) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
+	var result []metric.Metric
+	seen := make(map[model.Fingerprint]bool)
+	for _, input := range s.inputs {
+		metrics, err := input.MetricsForLabelMatchers(ctx, from, through, matcherSets...)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range metrics {
+			fp := m.Metric.Fingerprint()
+			if seen[fp] {
+				continue
+			}
+			seen[fp] = true
+			result = append(result, m)
+		}
+	}
+
+	return result, nil
+}
+
+// mergeSamples merges the samples of a series from several inputs, which are
+// sorted by timestamp, and returns the number of dropped duplicates.
+func (s *mergeStorage) mergeSamples(lists [][]model.SamplePair) ([]model.SamplePair, int) {
+	dropped := 0
+	switch s.policy {
+	case cfg.DedupePreferFirst:
+		result := lists[0]
+		for _, l := range lists[1:] {
+			var fill []model.SamplePair
+			for _, sample := range l {
+				if hasSampleWithin(result, sample.Timestamp, s.tolerance) {
+					dropped++
+					continue
+				}
+				fill = append(fill, sample)
+			}
+			result = mergeSorted(result, fill)
+		}
+		return result, dropped
+	default:
+		merged := lists[0]
+		for _, l := range lists[1:] {
+			merged = mergeSorted(merged, l)
+		}
+
+		result := make([]model.SamplePair, 0, len(merged))
+		for _, sample := range merged {
+			if len(result) > 0 && sample.Timestamp-result[len(result)-1].Timestamp <= s.tolerance {
+				dropped++
+				continue
+			}
+			result = append(result, sample)
+		}
+		return result, dropped
+	}
+}
+
+// hasSampleWithin returns true if the sorted samples contain a sample at most
+// tolerance away from t.
+func hasSampleWithin(samples []model.SamplePair, t, tolerance model.Time) bool {
+	i := sort.Search(len(samples), func(i int) bool {
+		return samples[i].Timestamp >= t-tolerance
+	})
+
+	return i < len(samples) && samples[i].Timestamp <= t+tolerance
+}
+
+// mergeSorted merges two lists of samples sorted by timestamp. Samples of a
+// with the same timestamp as samples of b come first.
+func mergeSorted(a, b []model.SamplePair) []model.SamplePair {
+	if len(b) == 0 {
+		return a
+	}
+	if len(a) == 0 {
+		return b
+	}
+
+	result := make([]model.SamplePair, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if b[j].Timestamp < a[i].Timestamp {
+			result = append(result, b[j])
+			j++
+			continue
+		}
+		result = append(result, a[i])
+		i++
+	}
+	result = append(result, a[i:]...)
+	return append(result, b[j:]...)
+}
+
+// mergeIterator reads a series from all inputs containing it.
+type mergeIterator struct {
+	storage   *mergeStorage
+	iterators []local.SeriesIterator
+}
+
+func (it *mergeIterator) ValueAtOrBeforeTime(t model.Time) model.SamplePair {
+	result := model.ZeroSamplePair
+	for _, iterator := range it.iterators {
+		sample := iterator.ValueAtOrBeforeTime(t)
+		if sample.Timestamp > result.Timestamp {
+			result = sample
+		}
+	}
+
+	return result
+}
+
+func (it *mergeIterator) RangeValues(in metric.Interval) []model.SamplePair {
+	if len(it.iterators) == 1 {
+		return it.iterators[0].RangeValues(in)
+	}
+
+	lists := make([][]model.SamplePair, len(it.iterators))
+	for i, iterator := range it.iterators {
+		lists[i] = iterator.RangeValues(in)
+	}
+
+	samples, dropped := it.storage.mergeSamples(lists)
+	duplicatesDropped.Add(float64(dropped))
+	return samples
+}
+
+func (it *mergeIterator) Err() error {
+	for _, iterator := range it.iterators {
+		if err := iteratorErr(iterator); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (it *mergeIterator) Metric() metric.Metric {
+	return it.iterators[0].Metric()
+}
+
+func (it *mergeIterator) Close() {
+	for _, iterator := range it.iterators {
+		iterator.Close()
+	}
+}
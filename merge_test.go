@@ -0,0 +1,128 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	cfg "github.com/xperimental/tsdb-migrate/config"
+)
+
+// samples returns samples with the timestamps and values given as pairs.
+func samples(pairs ...float64) []model.SamplePair {
+	result := []model.SamplePair{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		result = append(result, model.SamplePair{
+			Timestamp: model.Time(pairs[i]),
+			Value:     model.SampleValue(pairs[i+1]),
+		})
+	}
+	return result
+}
+
+func TestMergeSorted(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		a, b []model.SamplePair
+		want []model.SamplePair
+	}{
+		{name: "empty", a: samples(), b: samples(), want: samples()},
+		{name: "empty a", a: samples(), b: samples(1, 1), want: samples(1, 1)},
+		{name: "empty b", a: samples(1, 1), b: samples(), want: samples(1, 1)},
+		{name: "interleaved", a: samples(1, 1, 3, 3), b: samples(2, 2, 4, 4), want: samples(1, 1, 2, 2, 3, 3, 4, 4)},
+		{name: "tie", a: samples(1, 1, 2, 2), b: samples(2, 20, 3, 30), want: samples(1, 1, 2, 2, 2, 20, 3, 30)},
+		{name: "b first", a: samples(5, 5), b: samples(1, 10, 2, 20), want: samples(1, 10, 2, 20, 5, 5)},
+	} {
+		if got := mergeSorted(test.a, test.b); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMergeSamples(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		policy    string
+		tolerance time.Duration
+		lists     [][]model.SamplePair
+		want      []model.SamplePair
+		dropped   int
+	}{
+		{
+			name:    "drop identical timestamps keeps first input",
+			policy:  cfg.DedupeDropWithinTolerance,
+			lists:   [][]model.SamplePair{samples(10, 1, 20, 2), samples(10, 10, 20, 20, 30, 30)},
+			want:    samples(10, 1, 20, 2, 30, 30),
+			dropped: 2,
+		},
+		{
+			name:      "drop at tolerance edge",
+			policy:    cfg.DedupeDropWithinTolerance,
+			tolerance: 5 * time.Millisecond,
+			lists:     [][]model.SamplePair{samples(10, 1, 30, 3), samples(15, 2, 36, 4)},
+			want:      samples(10, 1, 30, 3, 36, 4),
+			dropped:   1,
+		},
+		{
+			name:      "drop compares with the last kept sample",
+			policy:    cfg.DedupeDropWithinTolerance,
+			tolerance: 5 * time.Millisecond,
+			lists:     [][]model.SamplePair{samples(10, 1), samples(14, 2, 18, 3)},
+			want:      samples(10, 1, 18, 3),
+			dropped:   1,
+		},
+		{
+			name:    "drop with empty inputs",
+			policy:  cfg.DedupeDropWithinTolerance,
+			lists:   [][]model.SamplePair{samples(), samples(10, 1), samples()},
+			want:    samples(10, 1),
+			dropped: 0,
+		},
+		{
+			name:    "drop single samples",
+			policy:  cfg.DedupeDropWithinTolerance,
+			lists:   [][]model.SamplePair{samples(10, 1), samples(10, 2)},
+			want:    samples(10, 1),
+			dropped: 1,
+		},
+		{
+			name:      "prefer first fills gaps",
+			policy:    cfg.DedupePreferFirst,
+			tolerance: 5 * time.Millisecond,
+			lists:     [][]model.SamplePair{samples(10, 1, 40, 4), samples(11, 10, 20, 20, 30, 30, 41, 40)},
+			want:      samples(10, 1, 20, 20, 30, 30, 40, 4),
+			dropped:   2,
+		},
+		{
+			name:      "prefer first at tolerance edges",
+			policy:    cfg.DedupePreferFirst,
+			tolerance: 5 * time.Millisecond,
+			lists:     [][]model.SamplePair{samples(20, 1), samples(14, 2, 15, 3, 25, 4, 26, 5)},
+			want:      samples(14, 2, 20, 1, 26, 5),
+			dropped:   2,
+		},
+		{
+			// Samples of later inputs are kept even if they are close to each other.
+			name:      "prefer first keeps fill samples",
+			policy:    cfg.DedupePreferFirst,
+			tolerance: 5 * time.Millisecond,
+			lists:     [][]model.SamplePair{samples(), samples(10, 1, 12, 2)},
+			want:      samples(10, 1, 12, 2),
+			dropped:   0,
+		},
+		{
+			name:    "prefer first with three inputs",
+			policy:  cfg.DedupePreferFirst,
+			lists:   [][]model.SamplePair{samples(10, 1), samples(10, 2, 20, 2), samples(10, 3, 20, 3, 30, 3)},
+			want:    samples(10, 1, 20, 2, 30, 3),
+			dropped: 3,
+		},
+	} {
+		s := newMergeStorage(nil, test.policy, test.tolerance)
+		got, dropped := s.mergeSamples(test.lists)
+		if !reflect.DeepEqual(got, test.want) || dropped != test.dropped {
+			t.Errorf("%s: got %v with %d dropped, want %v with %d dropped", test.name, got, dropped, test.want, test.dropped)
+		}
+	}
+}
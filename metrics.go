@@ -0,0 +1,133 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const metricsNamespace = "tsdb_migrate"
+
+var (
+	seriesConverted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "series_converted_total",
+		Help:      "Number of converted series. In time mode a series is counted once for every window.",
+	})
+	samplesAppended = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "samples_appended_total",
+		Help:      "Number of samples appended to the output.",
+	})
+	appendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "append_errors_total",
+		Help:      "Number of samples which could not be appended to the output.",
+	}, []string{"reason"})
+	windowsConverted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "windows_converted_total",
+		Help:      "Number of time windows converted in time mode.",
+	})
+	batchesConverted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "batches_converted_total",
+		Help:      "Number of batches of series converted in series mode.",
+	})
+	currentWindow = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "current_window_timestamp_seconds",
+		Help:      "Start of the time window which is currently converted in time mode.",
+	})
+	windowWidth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "window_width_seconds",
+		Help:      "Width of the time window which is currently converted in time mode.",
+	})
+	duplicatesDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "duplicate_samples_dropped_total",
+		Help:      "Number of samples dropped as duplicates when merging the series of several inputs.",
+	})
+	samplesDownsampled = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "downsampled_samples_dropped_total",
+		Help:      "Number of samples dropped by downsampling old data.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(seriesConverted, samplesAppended, appendErrors, windowsConverted, batchesConverted, currentWindow, windowWidth, duplicatesDropped, samplesDownsampled)
+}
+
+func serveMetrics(addr string) {
+	http.Handle("/metrics", promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, outputMetrics}, promhttp.HandlerOpts{}))
+
+	log.Printf("Serving metrics on %s", addr)
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		log.Fatalf("Error starting web server: %s", err)
+	}
+}
+
+// outputMetrics collects the metrics of the block writers of a split output.
+var outputMetrics = &dirGatherer{registries: make(map[string]*prometheus.Registry)}
+
+// dirGatherer keeps one registry per output directory, so that the compactor of
+// every directory can register its metrics. The gathered metrics have a dir
+// label with the directory.
+type dirGatherer struct {
+	mtx        sync.Mutex
+	registries map[string]*prometheus.Registry
+}
+
+// Registerer returns a new registry for the metrics of dir, which replaces the
+// registry of an earlier writer of the directory.
+func (g *dirGatherer) Registerer(dir string) prometheus.Registerer {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	r := prometheus.NewRegistry()
+	g.registries[dir] = r
+	return r
+}
+
+// Gather returns the metrics of all directories.
+func (g *dirGatherer) Gather() ([]*dto.MetricFamily, error) {
+	g.mtx.Lock()
+	gatherers := make(prometheus.Gatherers, 0, len(g.registries))
+	for dir, r := range g.registries {
+		gatherers = append(gatherers, labelGatherer{gatherer: r, name: "dir", value: dir})
+	}
+	g.mtx.Unlock()
+
+	return gatherers.Gather()
+}
+
+// labelGatherer adds a label to all metrics of a gatherer.
+type labelGatherer struct {
+	gatherer    prometheus.Gatherer
+	name, value string
+}
+
+func (g labelGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.gatherer.Gather()
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			m.Label = append(m.Label, &dto.LabelPair{
+				Name:  proto.String(g.name),
+				Value: proto.String(g.value),
+			})
+			sort.Slice(m.Label, func(i, j int) bool {
+				return m.Label[i].GetName() < m.Label[j].GetName()
+			})
+		}
+	}
+
+	return mfs, err
+}
@@ -0,0 +1,361 @@
+package reader
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/local/codable"
+)
+
+var (
+	// upMetric is a series in heads.db with persisted chunks and a head
+	// chunk.
+	upMetric = model.Metric{model.MetricNameLabel: "up", "job": "a"}
+	// downMetric is an archived series.
+	downMetric = model.Metric{model.MetricNameLabel: "down", "job": "b"}
+
+	// The samples appended to the storage fixture.
+	upSamples   []model.SamplePair
+	downSamples []model.SamplePair
+
+	storageOnce sync.Once
+	storageDir  string
+	storageErr  error
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	code := m.Run()
+	if storageDir != "" {
+		os.RemoveAll(storageDir)
+	}
+	os.Exit(code)
+}
+
+// fixtureStorage returns the directory of a storage written by the 1.x
+// storage engine. The engine only persists and archives series in its
+// maintenance loop, which takes about 20 seconds, so the directory is shared
+// by all tests and must not be modified.
+func fixtureStorage(t *testing.T) string {
+	storageOnce.Do(func() {
+		storageDir, storageErr = writeStorage()
+	})
+	if storageErr != nil {
+		t.Fatalf("error writing storage fixture: %s", storageErr)
+	}
+
+	return storageDir
+}
+
+func writeStorage() (string, error) {
+	dir, err := ioutil.TempDir("", "reader")
+	if err != nil {
+		return "", err
+	}
+
+	s := local.NewMemorySeriesStorage(&local.MemorySeriesStorageOptions{
+		// Evict every chunk as soon as it is persisted.
+		TargetHeapSize:         1,
+		PersistenceStoragePath: dir,
+		// The maintenance loop visits all series in a tenth of the
+		// retention. Samples older than the retention are dropped.
+		PersistenceRetentionPeriod: time.Minute,
+		HeadChunkTimeout:           5 * time.Second,
+		CheckpointInterval:         time.Hour,
+		CheckpointDirtySeriesLimit: 5000,
+		SyncStrategy:               local.Never,
+		MinShrinkRatio:             0.1,
+		NumMutexes:                 16,
+	})
+	if err := s.Start(); err != nil {
+		return dir, err
+	}
+
+	now := model.Now()
+	downSamples = testSamples(now.Add(-30*time.Second), now.Add(-20*time.Second), 50*time.Millisecond)
+	// Samples in the future keep the head chunk open, so the series is not
+	// archived.
+	upSamples = testSamples(now.Add(-30*time.Second), now.Add(30*time.Second), 100*time.Millisecond)
+
+	for m, samples := range map[*model.Metric][]model.SamplePair{&downMetric: downSamples, &upMetric: upSamples} {
+		for _, sample := range samples {
+			if err := s.Append(&model.Sample{Metric: *m, Timestamp: sample.Timestamp, Value: sample.Value}); err != nil {
+				s.Stop()
+				return dir, err
+			}
+		}
+	}
+	s.WaitForIndexing()
+
+	if err := waitForArchive(s, time.Minute); err != nil {
+		s.Stop()
+		return dir, err
+	}
+
+	return dir, s.Stop()
+}
+
+// testSamples returns samples from start up to end with values which do not
+// compress well, so that the series have several chunks.
+func testSamples(start, end model.Time, step time.Duration) []model.SamplePair {
+	var result []model.SamplePair
+	for t := start; t < end; t = t.Add(step) {
+		result = append(result, model.SamplePair{
+			Timestamp: t,
+			Value:     model.SampleValue(math.Sin(float64(t))),
+		})
+	}
+	return result
+}
+
+// waitForArchive waits until the storage has archived a series.
+func waitForArchive(s *local.MemorySeriesStorage, timeout time.Duration) error {
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(s); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		families, err := registry.Gather()
+		if err != nil {
+			return err
+		}
+
+		for _, f := range families {
+			if f.GetName() != "prometheus_local_storage_series_ops_total" {
+				continue
+			}
+			for _, m := range f.GetMetric() {
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "type" && l.GetValue() == "archive" && m.GetCounter().GetValue() > 0 {
+						return nil
+					}
+				}
+			}
+		}
+
+		// The storage only evicts chunks after a garbage collection.
+		runtime.GC()
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	return fmt.Errorf("no series archived after %s", timeout)
+}
+
+// writeModified writes the content of src changed by modify to filename.
+func writeModified(t *testing.T, filename, src string, modify func([]byte) []byte) {
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filename, modify(b), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// putVersion replaces the varint following the magic string.
+func putVersion(b []byte, magic string, version int64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(buf, version)
+	_, oldLen := binary.Varint(b[len(magic):])
+
+	result := append([]byte{}, b[:len(magic)]...)
+	result = append(result, buf[:n]...)
+	return append(result, b[len(magic)+oldLen:]...)
+}
+
+func newChunk(samples []model.SamplePair) chunk.Chunk {
+	c, err := chunk.NewForEncoding(chunk.DoubleDelta)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, s := range samples {
+		chunks, err := c.Add(s)
+		if err != nil {
+			panic(err)
+		}
+		if len(chunks) != 1 {
+			panic("fixture chunk overflowed")
+		}
+		c = chunks[0]
+	}
+
+	return c
+}
+
+// headsSeries is a series of a heads.db fixture. The persisted chunks are
+// written as their time ranges and the head chunks are encoded completely.
+type headsSeries struct {
+	flags            byte
+	metric           model.Metric
+	chunkDescsOffset int64
+	savedFirstTime   int64
+	persisted        [][2]int64
+	head             []chunk.Chunk
+}
+
+// writeLegacyHeads writes a heads.db in the format of Prometheus 1.0, which
+// the vendored storage engine can no longer write.
+func writeLegacyHeads(filename string, series []headsSeries) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	if _, err := w.WriteString(headsMagicString); err != nil {
+		return err
+	}
+	if _, err := codable.EncodeVarint(w, headsFormatLegacyVersion); err != nil {
+		return err
+	}
+	if err := codable.EncodeUint64(w, uint64(len(series))); err != nil {
+		return err
+	}
+
+	for _, s := range series {
+		if err := w.WriteByte(s.flags); err != nil {
+			return err
+		}
+		if err := codable.EncodeUint64(w, uint64(s.metric.FastFingerprint())); err != nil {
+			return err
+		}
+
+		buf, err := codable.Metric(s.metric).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+
+		for _, v := range []int64{s.chunkDescsOffset, s.savedFirstTime, int64(len(s.persisted) + len(s.head))} {
+			if _, err := codable.EncodeVarint(w, v); err != nil {
+				return err
+			}
+		}
+
+		for _, p := range s.persisted {
+			for _, t := range p {
+				if _, err := codable.EncodeVarint(w, t); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, c := range s.head {
+			if err := w.WriteByte(byte(c.Encoding())); err != nil {
+				return err
+			}
+			if err := c.Marshal(w); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeMappings writes a mappings.db. The storage engine maps colliding
+// fingerprints of FastFingerprint, which can not be produced in a test.
+func writeMappings(filename string, mappings map[model.Fingerprint]map[string]model.Fingerprint) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	if _, err := w.WriteString(mappingsMagicString); err != nil {
+		return err
+	}
+	if _, err := codable.EncodeUvarint(w, mappingsFormatVersion); err != nil {
+		return err
+	}
+	if _, err := codable.EncodeUvarint(w, uint64(len(mappings))); err != nil {
+		return err
+	}
+
+	for rawFP, m := range mappings {
+		if err := codable.EncodeUint64(w, uint64(rawFP)); err != nil {
+			return err
+		}
+		if _, err := codable.EncodeUvarint(w, uint64(len(m))); err != nil {
+			return err
+		}
+
+		for ms, fp := range m {
+			if _, err := codable.EncodeUvarint(w, uint64(len(ms))); err != nil {
+				return err
+			}
+			if _, err := w.WriteString(ms); err != nil {
+				return err
+			}
+			if err := codable.EncodeUint64(w, uint64(fp)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// tempDir returns a temporary directory and a function removing it.
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// samplesBetween returns the samples from from up to and including through.
+func samplesBetween(samples []model.SamplePair, from, through model.Time) []model.SamplePair {
+	result := []model.SamplePair{}
+	for _, s := range samples {
+		if !s.Timestamp.Before(from) && !s.Timestamp.After(through) {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// copyFile copies src into dir keeping the path relative to base.
+func copyFile(t *testing.T, base, src, dir string) string {
+	rel, err := filepath.Rel(base, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, rel)
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		t.Fatal(err)
+	}
+	writeModified(t, dst, src, func(b []byte) []byte { return b })
+	return dst
+}
@@ -0,0 +1,202 @@
+package reader
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/local/codable"
+)
+
+const (
+	headsFileName            = "heads.db"
+	headsFormatVersion       = 2
+	headsFormatLegacyVersion = 1
+	headsMagicString         = "PrometheusHeads"
+
+	flagheadChunkPersisted byte = 1 << 0
+
+	fileBufSize = 1 << 16
+)
+
+// headChunk describes a chunk of a series found in heads.db.
+type headChunk struct {
+	FirstTime model.Time
+	LastTime  model.Time
+	Persisted bool
+	Chunk     chunk.Chunk
+}
+
+// readHeads decodes the heads checkpoint (format version 1 or 2) written by
+// the storage engine and calls fn for every series in it.
+func readHeads(filename string, fn func(*Series)) error {
+	return scanHeads(filename, func(fp model.Fingerprint, m model.Metric, savedFirstTime model.Time, chunkDescsOffset int, chunks []headChunk) error {
+		s := &Series{
+			Fingerprint: fp,
+			Metric:      m,
+			FirstTime:   savedFirstTime,
+		}
+
+		if len(chunks) > 0 {
+			if chunkDescsOffset == 0 {
+				s.FirstTime = chunks[0].FirstTime
+			}
+			s.LastTime = chunks[len(chunks)-1].LastTime
+		}
+
+		for _, c := range chunks {
+			if !c.Persisted {
+				s.headChunks = append(s.headChunks, c.Chunk)
+			}
+		}
+
+		fn(s)
+		return nil
+	})
+}
+
+// scanHeads calls fn for every series in the heads checkpoint.
+func scanHeads(filename string, fn func(fp model.Fingerprint, m model.Metric, savedFirstTime model.Time, chunkDescsOffset int, chunks []headChunk) error) error {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, fileBufSize)
+
+	buf := make([]byte, len(headsMagicString))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	if magic := string(buf); magic != headsMagicString {
+		return fmt.Errorf("unexpected magic string, want %q, got %q", headsMagicString, magic)
+	}
+
+	version, err := binary.ReadVarint(r)
+	if err != nil {
+		return err
+	}
+	if version != headsFormatVersion && version != headsFormatLegacyVersion {
+		return fmt.Errorf("unknown heads format version, want %d, got %d", headsFormatVersion, version)
+	}
+
+	total, err := codable.DecodeUint64(r)
+	if err != nil {
+		return err
+	}
+
+	for i := uint64(0); i < total; i++ {
+		flags, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		fp, err := codable.DecodeUint64(r)
+		if err != nil {
+			return err
+		}
+
+		var m codable.Metric
+		if err := m.UnmarshalFromReader(r); err != nil {
+			return err
+		}
+
+		var persistWatermark int64
+		if version != headsFormatLegacyVersion {
+			if persistWatermark, err = binary.ReadVarint(r); err != nil {
+				return err
+			}
+			if persistWatermark < 0 {
+				return fmt.Errorf("found negative persist watermark: %d", persistWatermark)
+			}
+			// Modification time of the series file.
+			if _, err := binary.ReadVarint(r); err != nil {
+				return err
+			}
+		}
+
+		chunkDescsOffset, err := binary.ReadVarint(r)
+		if err != nil {
+			return err
+		}
+
+		savedFirstTime, err := binary.ReadVarint(r)
+		if err != nil {
+			return err
+		}
+
+		numChunkDescs, err := binary.ReadVarint(r)
+		if err != nil {
+			return err
+		}
+		if numChunkDescs < 0 {
+			return fmt.Errorf("found negative number of chunk descriptors: %d", numChunkDescs)
+		}
+
+		if version == headsFormatLegacyVersion {
+			persistWatermark = numChunkDescs - 1
+			if flags&flagheadChunkPersisted != 0 {
+				persistWatermark = numChunkDescs
+			}
+		}
+
+		chunks := make([]headChunk, numChunkDescs)
+		for j := int64(0); j < numChunkDescs; j++ {
+			if j < persistWatermark {
+				firstTime, err := binary.ReadVarint(r)
+				if err != nil {
+					return err
+				}
+				lastTime, err := binary.ReadVarint(r)
+				if err != nil {
+					return err
+				}
+
+				chunks[j] = headChunk{
+					FirstTime: model.Time(firstTime),
+					LastTime:  model.Time(lastTime),
+					Persisted: true,
+				}
+				continue
+			}
+
+			encoding, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+
+			c, err := chunk.NewForEncoding(chunk.Encoding(encoding))
+			if err != nil {
+				return err
+			}
+
+			if err := c.Unmarshal(r); err != nil {
+				return err
+			}
+
+			lastTime, err := c.NewIterator().LastTimestamp()
+			if err != nil {
+				return err
+			}
+
+			chunks[j] = headChunk{
+				FirstTime: c.FirstTime(),
+				LastTime:  lastTime,
+				Chunk:     c,
+			}
+		}
+
+		if err := fn(model.Fingerprint(fp), model.Metric(m), model.Time(savedFirstTime), int(chunkDescsOffset), chunks); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
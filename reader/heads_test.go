@@ -0,0 +1,162 @@
+package reader
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+func TestReadHeads(t *testing.T) {
+	heads := filepath.Join(fixtureStorage(t), headsFileName)
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	legacyHead := []model.SamplePair{{Timestamp: 3000, Value: 3}, {Timestamp: 4000, Value: 4}}
+	err := writeLegacyHeads(filepath.Join(dir, "heads-v1.db"), []headsSeries{
+		{
+			// Without the persisted flag the last chunk is a head chunk.
+			metric:           upMetric,
+			chunkDescsOffset: 3,
+			savedFirstTime:   500,
+			persisted:        [][2]int64{{1000, 2000}},
+			head:             []chunk.Chunk{newChunk(legacyHead)},
+		},
+		{
+			flags:          flagheadChunkPersisted,
+			metric:         downMetric,
+			savedFirstTime: 4000,
+			persisted:      [][2]int64{{5000, 6000}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeModified(t, filepath.Join(dir, "heads-bad-magic.db"), heads, func(b []byte) []byte {
+		b[0] = 'X'
+		return b
+	})
+	writeModified(t, filepath.Join(dir, "heads-v3.db"), heads, func(b []byte) []byte {
+		return putVersion(b, headsMagicString, 3)
+	})
+	writeModified(t, filepath.Join(dir, "heads-truncated.db"), heads, func(b []byte) []byte {
+		return b[:len(b)/2]
+	})
+
+	for _, test := range []struct {
+		name   string
+		file   string
+		series []Series
+		// samples contains the samples of every series. The head chunks
+		// have to contain a suffix of them.
+		samples [][]model.SamplePair
+		// unknownFirstTime allows model.Earliest as first time.
+		unknownFirstTime bool
+		err              string
+	}{
+		{
+			name: "storage",
+			file: heads,
+			series: []Series{
+				{
+					Fingerprint: upMetric.FastFingerprint(),
+					Metric:      upMetric,
+					FirstTime:   upSamples[0].Timestamp,
+					LastTime:    upSamples[len(upSamples)-1].Timestamp,
+				},
+			},
+			samples: [][]model.SamplePair{upSamples},
+			// The storage only saves the first time of series with
+			// persisted chunks after evicting their chunk descriptors.
+			unknownFirstTime: true,
+		},
+		{
+			// The first time is taken from the file if chunks have been
+			// dropped from the start of the series.
+			name: "legacy version",
+			file: filepath.Join(dir, "heads-v1.db"),
+			series: []Series{
+				{Fingerprint: upMetric.FastFingerprint(), Metric: upMetric, FirstTime: 500, LastTime: 4000},
+				{Fingerprint: downMetric.FastFingerprint(), Metric: downMetric, FirstTime: 5000, LastTime: 6000},
+			},
+			samples: [][]model.SamplePair{legacyHead, nil},
+		},
+		{
+			name: "missing",
+			file: filepath.Join(dir, "missing.db"),
+		},
+		{
+			name: "bad magic",
+			file: filepath.Join(dir, "heads-bad-magic.db"),
+			err:  "unexpected magic string",
+		},
+		{
+			name: "unknown version",
+			file: filepath.Join(dir, "heads-v3.db"),
+			err:  "unknown heads format version",
+		},
+		{
+			name: "truncated",
+			file: filepath.Join(dir, "heads-truncated.db"),
+			err:  "EOF",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var series []*Series
+			err := readHeads(test.file, func(s *Series) {
+				series = append(series, s)
+			})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %s", err)
+			}
+
+			if len(series) != len(test.series) {
+				t.Fatalf("got %d series, want %d", len(series), len(test.series))
+			}
+			for i, s := range series {
+				got := *s
+				got.headChunks = nil
+				if test.unknownFirstTime && got.FirstTime == model.Earliest {
+					got.FirstTime = test.series[i].FirstTime
+				}
+				if !reflect.DeepEqual(got, test.series[i]) {
+					t.Errorf("got series %+v, want %+v", got, test.series[i])
+				}
+
+				samples := chunkSamples(t, s.headChunks)
+				all := test.samples[i]
+				if len(samples) > len(all) || (len(samples) == 0) != (len(all) == 0) ||
+					!reflect.DeepEqual(samples, all[len(all)-len(samples):]) {
+					t.Errorf("got head samples %v, want a suffix of %v", samples, all)
+				}
+			}
+		})
+	}
+}
+
+func chunkSamples(t *testing.T, chunks []chunk.Chunk) []model.SamplePair {
+	var result []model.SamplePair
+	for _, c := range chunks {
+		samples, err := chunk.RangeValues(c.NewIterator(), metric.Interval{
+			OldestInclusive: model.Earliest,
+			NewestInclusive: model.Latest,
+		})
+		if err != nil {
+			t.Fatalf("error decoding chunk: %s", err)
+		}
+		result = append(result, samples...)
+	}
+
+	return result
+}
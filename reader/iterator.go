@@ -0,0 +1,244 @@
+package reader
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+const (
+	seriesFileSuffix           = ".db"
+	seriesDirNameLen           = 2
+	chunkHeaderLen             = 17
+	chunkHeaderTypeOffset      = 0
+	chunkHeaderFirstTimeOffset = 1
+	chunkLenWithHeader         = chunk.ChunkLen + chunkHeaderLen
+)
+
+type chunkDesc struct {
+	encoding  chunk.Encoding
+	firstTime model.Time
+	lastTime  model.Time
+	// offset of the chunk in the series file or -1 if it is only in heads.db.
+	offset int64
+	chunk  chunk.Chunk
+}
+
+func (r *Reader) seriesFileName(fp model.Fingerprint) string {
+	name := fp.String()
+	return filepath.Join(r.dir, name[:seriesDirNameLen], name[seriesDirNameLen:]+seriesFileSuffix)
+}
+
+// chunkDescs reads the chunk headers from the series file and adds the chunks
+// which only exist in heads.db.
+func (r *Reader) chunkDescs(s *Series) ([]chunkDesc, error) {
+	var descs []chunkDesc
+
+	f, err := os.Open(r.seriesFileName(s.Fingerprint))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		defer f.Close()
+
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+
+		if fi.Size()%chunkLenWithHeader != 0 {
+			return nil, fmt.Errorf("size of series file %d is not a multiple of the chunk length %d", fi.Size(), chunkLenWithHeader)
+		}
+
+		buf := make([]byte, chunkHeaderLen)
+		for offset := int64(0); offset < fi.Size(); offset += chunkLenWithHeader {
+			if _, err := f.ReadAt(buf, offset); err != nil {
+				return nil, err
+			}
+
+			descs = append(descs, chunkDesc{
+				encoding:  chunk.Encoding(buf[chunkHeaderTypeOffset]),
+				firstTime: model.Time(binary.LittleEndian.Uint64(buf[chunkHeaderFirstTimeOffset:])),
+				lastTime:  model.Time(binary.LittleEndian.Uint64(buf[chunkHeaderFirstTimeOffset+8:])),
+				offset:    offset,
+			})
+		}
+	}
+
+	for _, c := range s.headChunks {
+		// Chunks can already be in the series file if the storage crashed
+		// after persisting them.
+		if len(descs) > 0 && !c.FirstTime().After(descs[len(descs)-1].lastTime) {
+			continue
+		}
+
+		lastTime, err := c.NewIterator().LastTimestamp()
+		if err != nil {
+			return nil, err
+		}
+
+		descs = append(descs, chunkDesc{
+			encoding:  c.Encoding(),
+			firstTime: c.FirstTime(),
+			lastTime:  lastTime,
+			offset:    -1,
+			chunk:     c,
+		})
+	}
+
+	return descs, nil
+}
+
+// firstTime returns the time of the first sample of the series.
+func (r *Reader) firstTime(s *Series) (model.Time, error) {
+	descs, err := r.chunkDescs(s)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(descs) == 0 {
+		return s.LastTime, nil
+	}
+
+	return descs[0].firstTime, nil
+}
+
+func (r *Reader) newIterator(s *Series) (*seriesIterator, error) {
+	descs, err := r.chunkDescs(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &seriesIterator{
+		filename: r.seriesFileName(s.Fingerprint),
+		metric:   s.Metric,
+		descs:    descs,
+	}, nil
+}
+
+// seriesIterator implements local.SeriesIterator on top of the series file.
+// The interface can not return errors, so the iterator stops at the first
+// chunk which can not be read and returns the error from Err.
+type seriesIterator struct {
+	filename string
+	metric   model.Metric
+	descs    []chunkDesc
+	file     *os.File
+	err      error
+}
+
+func (it *seriesIterator) load(d chunkDesc) (chunk.Chunk, error) {
+	if d.offset < 0 {
+		return d.chunk, nil
+	}
+
+	if it.file == nil {
+		f, err := os.Open(it.filename)
+		if err != nil {
+			return nil, err
+		}
+		it.file = f
+	}
+
+	buf := make([]byte, chunkLenWithHeader)
+	if _, err := it.file.ReadAt(buf, d.offset); err != nil {
+		return nil, err
+	}
+
+	c, err := chunk.NewForEncoding(chunk.Encoding(buf[chunkHeaderTypeOffset]))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.UnmarshalFromBuf(buf[chunkHeaderLen:]); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// ValueAtOrBeforeTime implements local.SeriesIterator.
+func (it *seriesIterator) ValueAtOrBeforeTime(t model.Time) model.SamplePair {
+	for i := len(it.descs) - 1; i >= 0; i-- {
+		if it.descs[i].firstTime.After(t) {
+			continue
+		}
+
+		c, err := it.load(it.descs[i])
+		if err != nil {
+			it.setErr(fmt.Errorf("error loading chunk of %s: %s", it.metric, err))
+			return model.ZeroSamplePair
+		}
+
+		ci := c.NewIterator()
+		if ci.FindAtOrBefore(t) {
+			return ci.Value()
+		}
+		break
+	}
+
+	return model.ZeroSamplePair
+}
+
+// RangeValues implements local.SeriesIterator.
+func (it *seriesIterator) RangeValues(in metric.Interval) []model.SamplePair {
+	result := []model.SamplePair{}
+	if it.err != nil {
+		return result
+	}
+
+	for _, d := range it.descs {
+		if d.lastTime.Before(in.OldestInclusive) {
+			continue
+		}
+		if d.firstTime.After(in.NewestInclusive) {
+			break
+		}
+
+		c, err := it.load(d)
+		if err != nil {
+			it.setErr(fmt.Errorf("error loading chunk of %s: %s", it.metric, err))
+			return result
+		}
+
+		values, err := chunk.RangeValues(c.NewIterator(), in)
+		if err != nil {
+			it.setErr(fmt.Errorf("error decoding chunk of %s: %s", it.metric, err))
+			return result
+		}
+		result = append(result, values...)
+	}
+
+	return result
+}
+
+// Err returns the first error which occurred while reading a chunk. The
+// samples returned after it are incomplete.
+func (it *seriesIterator) Err() error {
+	return it.err
+}
+
+func (it *seriesIterator) setErr(err error) {
+	if it.err == nil {
+		it.err = err
+	}
+}
+
+// Metric implements local.SeriesIterator.
+func (it *seriesIterator) Metric() metric.Metric {
+	return metric.Metric{Metric: it.metric}
+}
+
+// Close implements local.SeriesIterator.
+func (it *seriesIterator) Close() {
+	if it.file != nil {
+		it.file.Close()
+		it.file = nil
+	}
+}
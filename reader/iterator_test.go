@@ -0,0 +1,227 @@
+package reader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// fixtureSeries returns the series of the storage fixture.
+func fixtureSeries(t *testing.T, m model.Metric) (*Reader, *Series) {
+	r, err := Open(fixtureStorage(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, ok := r.Series(m.FastFingerprint())
+	if !ok {
+		t.Fatalf("series %s not found", m)
+	}
+
+	return r, s
+}
+
+// persistedChunks returns the number of chunks in the series file.
+func persistedChunks(t *testing.T, r *Reader, fp model.Fingerprint) int {
+	fi, err := os.Stat(r.seriesFileName(fp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return int(fi.Size() / chunkLenWithHeader)
+}
+
+func TestChunkDescs(t *testing.T) {
+	r, up := fixtureSeries(t, upMetric)
+	_, down := fixtureSeries(t, downMetric)
+	upPersisted := persistedChunks(t, r, up.Fingerprint)
+	if upPersisted == 0 || len(up.headChunks) == 0 {
+		t.Fatalf("got %d persisted and %d head chunks, want both", upPersisted, len(up.headChunks))
+	}
+
+	descs, err := r.chunkDescs(up)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastPersisted, err := (&seriesIterator{filename: r.seriesFileName(up.Fingerprint)}).load(descs[upPersisted-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	bad := (&Reader{dir: dir}).seriesFileName(up.Fingerprint)
+	if err := os.MkdirAll(filepath.Dir(bad), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(bad, make([]byte, chunkLenWithHeader+1), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		dir    string
+		series *Series
+		// samples are the samples covered by the chunks.
+		samples   []model.SamplePair
+		persisted int
+		head      int
+		err       string
+	}{
+		{
+			name:      "series file and head chunk",
+			dir:       r.dir,
+			series:    up,
+			samples:   upSamples,
+			persisted: upPersisted,
+			head:      len(up.headChunks),
+		},
+		{
+			// The head chunk has been persisted before a crash.
+			name:      "persisted head chunk",
+			dir:       r.dir,
+			series:    &Series{Fingerprint: up.Fingerprint, headChunks: []chunk.Chunk{lastPersisted}},
+			samples:   upSamples[:len(upSamples)-len(chunkSamples(t, up.headChunks))],
+			persisted: upPersisted,
+		},
+		{
+			name:    "only head chunk",
+			dir:     filepath.Join(dir, "missing"),
+			series:  up,
+			samples: chunkSamples(t, up.headChunks),
+			head:    len(up.headChunks),
+		},
+		{
+			name:      "archived",
+			dir:       r.dir,
+			series:    down,
+			samples:   downSamples,
+			persisted: persistedChunks(t, r, down.Fingerprint),
+		},
+		{
+			name:   "invalid size",
+			dir:    dir,
+			series: up,
+			err:    "not a multiple of the chunk length",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := &Reader{dir: test.dir}
+			descs, err := r.chunkDescs(test.series)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %s", err)
+			}
+
+			if len(descs) != test.persisted+test.head {
+				t.Fatalf("got %d chunks, want %d persisted and %d head chunks", len(descs), test.persisted, test.head)
+			}
+			for i, d := range descs {
+				offset := int64(-1)
+				if i < test.persisted {
+					offset = int64(i * chunkLenWithHeader)
+				}
+				if d.offset != offset || d.encoding != chunk.DoubleDelta || d.lastTime.Before(d.firstTime) {
+					t.Errorf("chunk %d: got %+v, want offset %d", i, d, offset)
+				}
+				if i > 0 && !d.firstTime.After(descs[i-1].lastTime) {
+					t.Errorf("chunk %d starts at %d before the end of the previous chunk at %d", i, d.firstTime, descs[i-1].lastTime)
+				}
+			}
+
+			first, last := test.samples[0].Timestamp, test.samples[len(test.samples)-1].Timestamp
+			if descs[0].firstTime != first || descs[len(descs)-1].lastTime != last {
+				t.Errorf("got chunks from %d to %d, want %d to %d", descs[0].firstTime, descs[len(descs)-1].lastTime, first, last)
+			}
+		})
+	}
+}
+
+func TestSeriesIterator(t *testing.T) {
+	r, up := fixtureSeries(t, upMetric)
+	it, err := r.newIterator(up)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	first, last := upSamples[0], upSamples[len(upSamples)-1]
+	for _, test := range []struct {
+		from, through model.Time
+		samples       []model.SamplePair
+	}{
+		{from: 0, through: model.Latest, samples: upSamples},
+		{from: upSamples[100].Timestamp, through: upSamples[400].Timestamp, samples: upSamples[100:401]},
+		{from: upSamples[100].Timestamp + 1, through: upSamples[101].Timestamp - 1, samples: []model.SamplePair{}},
+		{from: last.Timestamp, through: last.Timestamp, samples: []model.SamplePair{last}},
+		{from: last.Timestamp + 1, through: model.Latest, samples: []model.SamplePair{}},
+	} {
+		samples := it.RangeValues(metric.Interval{OldestInclusive: test.from, NewestInclusive: test.through})
+		if !reflect.DeepEqual(samples, test.samples) {
+			t.Errorf("%d-%d: got %d samples, want %d", test.from, test.through, len(samples), len(test.samples))
+		}
+	}
+
+	for _, test := range []struct {
+		t      model.Time
+		sample model.SamplePair
+	}{
+		{t: first.Timestamp - 1, sample: model.ZeroSamplePair},
+		{t: first.Timestamp, sample: first},
+		{t: upSamples[250].Timestamp + 1, sample: upSamples[250]},
+		{t: model.Latest, sample: last},
+	} {
+		if sample := it.ValueAtOrBeforeTime(test.t); sample != test.sample {
+			t.Errorf("%d: got %v, want %v", test.t, sample, test.sample)
+		}
+	}
+
+	if err := it.Err(); err != nil {
+		t.Errorf("got error: %s", err)
+	}
+}
+
+func TestSeriesIteratorErr(t *testing.T) {
+	r, up := fixtureSeries(t, upMetric)
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	// The series file is truncated after the chunks have been read.
+	filename := copyFile(t, r.dir, r.seriesFileName(up.Fingerprint), dir)
+	copied := &Reader{dir: dir}
+	iterators := make([]*seriesIterator, 2)
+	for i := range iterators {
+		it, err := copied.newIterator(up)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+		iterators[i] = it
+	}
+	if err := os.Truncate(filename, chunkLenWithHeader); err != nil {
+		t.Fatal(err)
+	}
+
+	it := iterators[0]
+	samples := it.RangeValues(metric.Interval{OldestInclusive: 0, NewestInclusive: model.Latest})
+	if len(samples) >= len(upSamples) || it.Err() == nil {
+		t.Errorf("got %d of %d samples and error %v, want an error", len(samples), len(upSamples), it.Err())
+	}
+
+	it = iterators[1]
+	if sample := it.ValueAtOrBeforeTime(it.descs[1].firstTime); sample != model.ZeroSamplePair || it.Err() == nil {
+		t.Errorf("got sample %v and error %v, want an error", sample, it.Err())
+	}
+}
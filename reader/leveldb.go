@@ -0,0 +1,36 @@
+package reader
+
+import (
+	"os"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// forEachEntry opens the LevelDB in dir read-only and calls fn for every
+// key-value pair. A missing database is treated as empty.
+func forEachEntry(dir string, fn func(key, value []byte) error) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+
+	db, err := leveldb.OpenFile(dir, &opt.Options{
+		ReadOnly:       true,
+		ErrorIfMissing: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	it := db.NewIterator(nil, &opt.ReadOptions{DontFillCache: true})
+	defer it.Release()
+
+	for it.Next() {
+		if err := fn(it.Key(), it.Value()); err != nil {
+			return err
+		}
+	}
+
+	return it.Error()
+}
@@ -0,0 +1,91 @@
+package reader
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/codable"
+)
+
+const (
+	mappingsFileName      = "mappings.db"
+	mappingsFormatVersion = 1
+	mappingsMagicString   = "PrometheusMappings"
+)
+
+// readMappings decodes the fingerprint mappings which the storage engine uses
+// to resolve fingerprint collisions. The result maps the raw fingerprint to
+// the mapped fingerprints of every colliding metric.
+func readMappings(filename string) (map[model.Fingerprint]map[string]model.Fingerprint, error) {
+	result := make(map[model.Fingerprint]map[string]model.Fingerprint)
+
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, fileBufSize)
+
+	buf := make([]byte, len(mappingsMagicString))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	if magic := string(buf); magic != mappingsMagicString {
+		return nil, fmt.Errorf("unexpected magic string, want %q, got %q", mappingsMagicString, magic)
+	}
+
+	version, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if version != mappingsFormatVersion {
+		return nil, fmt.Errorf("unknown mappings format version, want %d, got %d", mappingsFormatVersion, version)
+	}
+
+	numRawFPs, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	for ; numRawFPs > 0; numRawFPs-- {
+		rawFP, err := codable.DecodeUint64(r)
+		if err != nil {
+			return nil, err
+		}
+
+		numMappings, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+
+		mappings := make(map[string]model.Fingerprint, numMappings)
+		for ; numMappings > 0; numMappings-- {
+			length, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, err
+			}
+
+			buf := make([]byte, length)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return nil, err
+			}
+
+			fp, err := codable.DecodeUint64(r)
+			if err != nil {
+				return nil, err
+			}
+
+			mappings[string(buf)] = model.Fingerprint(fp)
+		}
+		result[model.Fingerprint(rawFP)] = mappings
+	}
+
+	return result, nil
+}
@@ -0,0 +1,90 @@
+package reader
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestReadMappings(t *testing.T) {
+	storage := fixtureStorage(t)
+	mappings := filepath.Join(storage, mappingsFileName)
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	collisions := map[model.Fingerprint]map[string]model.Fingerprint{
+		0xabc: {
+			`up{job="a"}`:  1,
+			`up{job="a2"}`: 2,
+		},
+	}
+	if err := writeMappings(filepath.Join(dir, "collisions.db"), collisions); err != nil {
+		t.Fatal(err)
+	}
+
+	writeModified(t, filepath.Join(dir, "mappings-v2.db"), mappings, func(b []byte) []byte {
+		b[len(mappingsMagicString)] = 2
+		return b
+	})
+	writeModified(t, filepath.Join(dir, "mappings-truncated.db"), mappings, func(b []byte) []byte {
+		return b[:len(b)-1]
+	})
+
+	for _, test := range []struct {
+		name     string
+		file     string
+		mappings map[model.Fingerprint]map[string]model.Fingerprint
+		err      string
+	}{
+		{
+			name:     "storage",
+			file:     mappings,
+			mappings: map[model.Fingerprint]map[string]model.Fingerprint{},
+		},
+		{
+			name:     "collisions",
+			file:     filepath.Join(dir, "collisions.db"),
+			mappings: collisions,
+		},
+		{
+			name:     "missing",
+			file:     filepath.Join(dir, "missing.db"),
+			mappings: map[model.Fingerprint]map[string]model.Fingerprint{},
+		},
+		{
+			name: "bad magic",
+			file: filepath.Join(storage, headsFileName),
+			err:  "unexpected magic string",
+		},
+		{
+			name: "unknown version",
+			file: filepath.Join(dir, "mappings-v2.db"),
+			err:  "unknown mappings format version",
+		},
+		{
+			name: "truncated",
+			file: filepath.Join(dir, "mappings-truncated.db"),
+			err:  "EOF",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			mappings, err := readMappings(test.file)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %s", err)
+			}
+
+			if !reflect.DeepEqual(mappings, test.mappings) {
+				t.Errorf("got mappings %v, want %v", mappings, test.mappings)
+			}
+		})
+	}
+}
@@ -0,0 +1,311 @@
+// Package reader provides read-only access to the files of a Prometheus 1.x
+// local storage directory without starting the storage engine.
+package reader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/local/codable"
+	"github.com/prometheus/prometheus/storage/local/index"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+const (
+	supportedVersion = "1"
+	versionFileName  = "VERSION"
+	dirtyFileName    = "DIRTY"
+)
+
+// Series contains the information about one series of the storage.
+type Series struct {
+	Fingerprint model.Fingerprint
+	Metric      model.Metric
+	Archived    bool
+	// FirstTime is model.Earliest until TimeRange has been called if the
+	// storage does not know it.
+	FirstTime model.Time
+	LastTime  model.Time
+
+	// Chunks from heads.db which have not been persisted to the series file.
+	headChunks []chunk.Chunk
+}
+
+// Reader reads the series of a local storage directory. It never writes to
+// the directory and does not take the lock used by the storage engine.
+type Reader struct {
+	dir      string
+	version  string
+	dirty    bool
+	series   map[model.Fingerprint]*Series
+	fps      model.Fingerprints
+	postings map[model.LabelPair]model.Fingerprints
+	mappings map[model.Fingerprint]map[string]model.Fingerprint
+}
+
+// Open reads the series index of the storage in dir.
+func Open(dir string) (*Reader, error) {
+	version, err := ioutil.ReadFile(filepath.Join(dir, versionFileName))
+	if err != nil {
+		return nil, fmt.Errorf("error reading version: %s", err)
+	}
+
+	if v := strings.TrimSpace(string(version)); v != supportedVersion {
+		return nil, fmt.Errorf("unsupported storage version: %s", v)
+	}
+
+	r := &Reader{
+		dir:      dir,
+		version:  strings.TrimSpace(string(version)),
+		series:   make(map[model.Fingerprint]*Series),
+		postings: make(map[model.LabelPair]model.Fingerprints),
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, dirtyFileName)); err == nil {
+		r.dirty = true
+	}
+
+	r.mappings, err = readMappings(filepath.Join(dir, mappingsFileName))
+	if err != nil {
+		return nil, fmt.Errorf("error reading mappings: %s", err)
+	}
+
+	if err := readHeads(filepath.Join(dir, headsFileName), r.addSeries); err != nil {
+		return nil, fmt.Errorf("error reading heads: %s", err)
+	}
+
+	if err := r.readArchive(); err != nil {
+		return nil, fmt.Errorf("error reading archive: %s", err)
+	}
+
+	r.fps = make(model.Fingerprints, 0, len(r.series))
+	for fp := range r.series {
+		r.fps = append(r.fps, fp)
+	}
+	sort.Sort(r.fps)
+
+	return r, nil
+}
+
+// Version returns the format version of the storage.
+func (r *Reader) Version() string {
+	return r.version
+}
+
+// Dirty returns true if the storage has not been shut down cleanly.
+func (r *Reader) Dirty() bool {
+	return r.dirty
+}
+
+// Mappings returns the number of fingerprints which had to be remapped by
+// the storage because of collisions.
+func (r *Reader) Mappings() int {
+	count := 0
+	for _, m := range r.mappings {
+		count += len(m)
+	}
+	return count
+}
+
+// Fingerprints returns the fingerprints of all series in ascending order.
+func (r *Reader) Fingerprints() model.Fingerprints {
+	return r.fps
+}
+
+// LabelNames returns the names of all labels in ascending order.
+func (r *Reader) LabelNames() model.LabelNames {
+	seen := make(map[model.LabelName]bool)
+	var names model.LabelNames
+	for pair := range r.postings {
+		if !seen[pair.Name] {
+			seen[pair.Name] = true
+			names = append(names, pair.Name)
+		}
+	}
+	sort.Sort(names)
+
+	return names
+}
+
+// Series returns the series with the fingerprint fp.
+func (r *Reader) Series(fp model.Fingerprint) (*Series, bool) {
+	s, ok := r.series[fp]
+	return s, ok
+}
+
+// TimeRange returns the times of the oldest and the newest sample in the
+// storage.
+func (r *Reader) TimeRange() (first, last model.Time, err error) {
+	if len(r.series) == 0 {
+		return 0, 0, errors.New("storage contains no series")
+	}
+
+	first, last = model.Latest, model.Earliest
+	for _, s := range r.series {
+		if s.FirstTime == model.Earliest {
+			// The storage does not always know the first time of series with
+			// persisted chunks.
+			if s.FirstTime, err = r.firstTime(s); err != nil {
+				return 0, 0, fmt.Errorf("error reading series %s: %s", s.Fingerprint, err)
+			}
+		}
+
+		if s.FirstTime.Before(first) {
+			first = s.FirstTime
+		}
+		if s.LastTime.After(last) {
+			last = s.LastTime
+		}
+	}
+
+	if last.Before(first) {
+		last = first
+	}
+
+	return first, last, nil
+}
+
+func (r *Reader) addSeries(s *Series) {
+	r.series[s.Fingerprint] = s
+	for name, value := range s.Metric {
+		pair := model.LabelPair{Name: name, Value: value}
+		r.postings[pair] = append(r.postings[pair], s.Fingerprint)
+	}
+}
+
+func (r *Reader) readArchive() error {
+	ranges := make(map[model.Fingerprint]codable.TimeRange)
+	err := forEachEntry(filepath.Join(r.dir, index.FingerprintTimeRangeDir), func(key, value []byte) error {
+		var fp codable.Fingerprint
+		if err := fp.UnmarshalBinary(key); err != nil {
+			return err
+		}
+
+		var tr codable.TimeRange
+		if err := tr.UnmarshalBinary(value); err != nil {
+			return err
+		}
+
+		ranges[model.Fingerprint(fp)] = tr
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error reading time ranges: %s", err)
+	}
+
+	return forEachEntry(filepath.Join(r.dir, index.FingerprintToMetricDir), func(key, value []byte) error {
+		var fp codable.Fingerprint
+		if err := fp.UnmarshalBinary(key); err != nil {
+			return err
+		}
+
+		if _, ok := r.series[model.Fingerprint(fp)]; ok {
+			// Series in heads.db take precedence.
+			return nil
+		}
+
+		var m codable.Metric
+		if err := m.UnmarshalBinary(value); err != nil {
+			return err
+		}
+
+		tr := ranges[model.Fingerprint(fp)]
+		r.addSeries(&Series{
+			Fingerprint: model.Fingerprint(fp),
+			Metric:      model.Metric(m),
+			Archived:    true,
+			FirstTime:   tr.First,
+			LastTime:    tr.Last,
+		})
+		return nil
+	})
+}
+
+// QueryRange returns iterators for all series matching the matchers and
+// having samples between from and through.
+func (r *Reader) QueryRange(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]local.SeriesIterator, error) {
+	var result []local.SeriesIterator
+	for _, fp := range r.candidates(matchers) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		s := r.series[fp]
+		if !s.matches(from, through, matchers) {
+			continue
+		}
+
+		it, err := r.newIterator(s)
+		if err != nil {
+			return nil, fmt.Errorf("error reading series %s: %s", fp, err)
+		}
+		result = append(result, it)
+	}
+
+	return result, nil
+}
+
+// MetricsForLabelMatchers returns the metrics of all series matching one of
+// the matcher sets and having samples between from and through.
+func (r *Reader) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
+	seen := make(map[model.Fingerprint]bool)
+	var result []metric.Metric
+	for _, matchers := range matcherSets {
+		for _, fp := range r.candidates(matchers) {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			s := r.series[fp]
+			if seen[fp] || !s.matches(from, through, matchers) {
+				continue
+			}
+			seen[fp] = true
+
+			result = append(result, metric.Metric{Metric: s.Metric})
+		}
+	}
+
+	return result, nil
+}
+
+// candidates returns the fingerprints which can possibly match. It uses the
+// shortest postings list of the equality matchers.
+func (r *Reader) candidates(matchers []*metric.LabelMatcher) model.Fingerprints {
+	result := r.fps
+	for _, m := range matchers {
+		if m.Type != metric.Equal || m.MatchesEmptyString() {
+			continue
+		}
+
+		fps := r.postings[model.LabelPair{Name: m.Name, Value: m.Value}]
+		if len(fps) < len(result) {
+			result = fps
+		}
+	}
+
+	return result
+}
+
+func (s *Series) matches(from, through model.Time, matchers []*metric.LabelMatcher) bool {
+	if s.LastTime.Before(from) || s.FirstTime.After(through) {
+		return false
+	}
+
+	for _, m := range matchers {
+		if !m.Match(s.Metric[m.Name]) {
+			return false
+		}
+	}
+
+	return true
+}
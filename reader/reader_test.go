@@ -0,0 +1,149 @@
+package reader
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+func TestOpen(t *testing.T) {
+	r, err := Open(fixtureStorage(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Version() != supportedVersion || r.Dirty() {
+		t.Errorf("got version %q and dirty %t", r.Version(), r.Dirty())
+	}
+
+	if r.Mappings() != 0 {
+		t.Errorf("got %d mappings, want 0", r.Mappings())
+	}
+
+	// TimeRange reads the first times which are not in heads.db.
+	first, last, err := r.TimeRange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := upSamples[len(upSamples)-1].Timestamp; first != downSamples[0].Timestamp || last != want {
+		t.Errorf("got time range %d - %d, want %d - %d", first, last, downSamples[0].Timestamp, want)
+	}
+
+	for _, test := range []struct {
+		metric   model.Metric
+		archived bool
+		first    model.Time
+		last     model.Time
+	}{
+		{metric: upMetric, first: upSamples[0].Timestamp, last: upSamples[len(upSamples)-1].Timestamp},
+		{metric: downMetric, archived: true, first: downSamples[0].Timestamp, last: downSamples[len(downSamples)-1].Timestamp},
+	} {
+		s, ok := r.Series(test.metric.FastFingerprint())
+		if !ok {
+			t.Errorf("series %s not found", test.metric)
+			continue
+		}
+
+		if !s.Metric.Equal(test.metric) || s.Archived != test.archived || s.FirstTime != test.first || s.LastTime != test.last {
+			t.Errorf("got series %s (archived %t) from %d to %d, want %s (archived %t) from %d to %d",
+				s.Metric, s.Archived, s.FirstTime, s.LastTime, test.metric, test.archived, test.first, test.last)
+		}
+	}
+
+	want := model.LabelNames{model.MetricNameLabel, "job"}
+	if names := r.LabelNames(); !reflect.DeepEqual(names, want) {
+		t.Errorf("got label names %v, want %v", names, want)
+	}
+}
+
+func TestQueryRange(t *testing.T) {
+	r, err := Open(fixtureStorage(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matcher := func(mt metric.MatchType, name model.LabelName, value model.LabelValue) *metric.LabelMatcher {
+		m, err := metric.NewLabelMatcher(mt, name, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	// Between the samples of downMetric.
+	middle := downSamples[len(downSamples)/2].Timestamp
+	for _, test := range []struct {
+		name          string
+		from, through model.Time
+		matchers      []*metric.LabelMatcher
+		samples       map[model.Fingerprint][]model.SamplePair
+	}{
+		{
+			name:    "all series",
+			from:    0,
+			through: model.Latest,
+			samples: map[model.Fingerprint][]model.SamplePair{
+				upMetric.FastFingerprint():   upSamples,
+				downMetric.FastFingerprint(): downSamples,
+			},
+		},
+		{
+			name:     "equality matcher",
+			from:     0,
+			through:  model.Latest,
+			matchers: []*metric.LabelMatcher{matcher(metric.Equal, "job", "b")},
+			samples: map[model.Fingerprint][]model.SamplePair{
+				downMetric.FastFingerprint(): downSamples,
+			},
+		},
+		{
+			name:     "regular expression matcher",
+			from:     0,
+			through:  model.Latest,
+			matchers: []*metric.LabelMatcher{matcher(metric.RegexMatch, model.MetricNameLabel, "u.*")},
+			samples: map[model.Fingerprint][]model.SamplePair{
+				upMetric.FastFingerprint(): upSamples,
+			},
+		},
+		{
+			name:    "time range",
+			from:    middle,
+			through: middle,
+			samples: map[model.Fingerprint][]model.SamplePair{
+				upMetric.FastFingerprint():   samplesBetween(upSamples, middle, middle),
+				downMetric.FastFingerprint(): samplesBetween(downSamples, middle, middle),
+			},
+		},
+		{
+			name:    "after archived series",
+			from:    downSamples[len(downSamples)-1].Timestamp + 1,
+			through: model.Latest,
+			samples: map[model.Fingerprint][]model.SamplePair{
+				upMetric.FastFingerprint(): samplesBetween(upSamples, downSamples[len(downSamples)-1].Timestamp+1, model.Latest),
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			iterators, err := r.QueryRange(context.Background(), test.from, test.through, test.matchers...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			samples := make(map[model.Fingerprint][]model.SamplePair)
+			for _, it := range iterators {
+				samples[it.Metric().Metric.FastFingerprint()] = it.RangeValues(metric.Interval{
+					OldestInclusive: test.from,
+					NewestInclusive: test.through,
+				})
+				it.Close()
+			}
+
+			if !reflect.DeepEqual(samples, test.samples) {
+				t.Errorf("got %v, want %v", samples, test.samples)
+			}
+		})
+	}
+}
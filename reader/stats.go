@@ -0,0 +1,82 @@
+package reader
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+
+	"github.com/prometheus/prometheus/storage/local/chunk"
+)
+
+// Stats summarizes the series and files of a storage directory.
+type Stats struct {
+	MemorySeries   int
+	ArchivedSeries int
+	// Chunks contains the number of chunks per encoding.
+	Chunks map[chunk.Encoding]int
+	// DirSizes contains the size of the series files per fingerprint prefix
+	// directory.
+	DirSizes map[string]int64
+}
+
+// Stats reads the chunk headers of all series and the sizes of the series
+// files.
+func (r *Reader) Stats() (*Stats, error) {
+	stats := &Stats{
+		Chunks:   make(map[chunk.Encoding]int),
+		DirSizes: make(map[string]int64),
+	}
+
+	for _, fp := range r.fps {
+		s := r.series[fp]
+		if s.Archived {
+			stats.ArchivedSeries++
+		} else {
+			stats.MemorySeries++
+		}
+
+		descs, err := r.chunkDescs(s)
+		if err != nil {
+			return nil, fmt.Errorf("error reading series %s: %s", fp, err)
+		}
+
+		for _, d := range descs {
+			stats.Chunks[d.encoding]++
+		}
+	}
+
+	files, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fi := range files {
+		if !fi.IsDir() || !isSeriesDir(fi.Name()) {
+			continue
+		}
+
+		seriesFiles, err := ioutil.ReadDir(filepath.Join(r.dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var size int64
+		for _, sf := range seriesFiles {
+			size += sf.Size()
+		}
+		stats.DirSizes[fi.Name()] = size
+	}
+
+	return stats, nil
+}
+
+// isSeriesDir returns true if name is a fingerprint prefix.
+func isSeriesDir(name string) bool {
+	if len(name) != seriesDirNameLen {
+		return false
+	}
+
+	_, err := strconv.ParseUint(name, 16, 8)
+	return err == nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/prometheus/common/model"
+	promconfig "github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/relabel"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/tsdb/labels"
+	cfg "github.com/xperimental/tsdb-migrate/config"
+)
+
+// labelRules contains the changes applied to the labels of every series.
+type labelRules struct {
+	relabelConfigs []*promconfig.RelabelConfig
+	externalLabels model.LabelSet
+	conflict       string
+}
+
+func labelRulesFromConfig(config cfg.MigrateConfig) labelRules {
+	return labelRules{
+		relabelConfigs: config.RelabelConfigs,
+		externalLabels: config.ExternalLabels,
+		conflict:       config.LabelConflict,
+	}
+}
+
+func (l labelRules) empty() bool {
+	return len(l.relabelConfigs) == 0 && len(l.externalLabels) == 0
+}
+
+// relabeler applies the relabel configs and the external labels to the input
+// series. If the resulting label sets of several series are identical, only
+// the series with the lowest fingerprint is converted and the others are
+// rejected. Series with label sets which can not be stored in TSDB are
+// rejected as well.
+type relabeler struct {
+	rules    labelRules
+	rejected map[model.Fingerprint]bool
+	skipped  []skippedSeries
+}
+
+// newRelabeler checks the relabeled label sets of the series for invalid
+// labels and collisions. It returns an error if the external labels conflict
+// with the labels of a series and conflicts are not allowed. The series need
+// to be sorted by fingerprint.
+func newRelabeler(rules labelRules, series []metric.Metric) (*relabeler, error) {
+	r := &relabeler{
+		rules:    rules,
+		rejected: make(map[model.Fingerprint]bool),
+	}
+
+	dropped := 0
+	owners := make(map[string]model.Metric, len(series))
+	for _, s := range series {
+		lset := model.LabelSet(s.Metric)
+		if !rules.empty() {
+			var err error
+			lset, err = r.apply(s.Metric)
+			if err != nil {
+				return nil, fmt.Errorf("series %s: %s", s.Metric, err)
+			}
+
+			if lset == nil {
+				dropped++
+				r.skipped = append(r.skipped, skippedSeries{
+					Labels: s.Metric.String(),
+					Reason: "dropped by relabeling",
+				})
+				continue
+			}
+		}
+
+		if err := validateLabels(lset); err != nil {
+			log.Printf("Rejecting series %s: %s", s.Metric, err)
+			r.reject(s.Metric, err.Error())
+			continue
+		}
+
+		if rules.empty() {
+			continue
+		}
+
+		key := lset.String()
+		if owner, ok := owners[key]; ok {
+			log.Printf("Rejecting series %s: relabeled labels %s collide with series %s", s.Metric, lset, owner)
+			r.reject(s.Metric, fmt.Sprintf("relabeled labels %s collide with series %s", lset, owner))
+			continue
+		}
+		owners[key] = s.Metric
+	}
+
+	if len(rules.relabelConfigs) > 0 {
+		log.Printf("Relabeling drops %d series.", dropped)
+	}
+	if len(r.rejected) > 0 {
+		log.Printf("Rejecting %d series.", len(r.rejected))
+	}
+	return r, nil
+}
+
+func (r *relabeler) reject(m model.Metric, reason string) {
+	r.rejected[m.Fingerprint()] = true
+	r.skipped = append(r.skipped, skippedSeries{
+		Labels: m.String(),
+		Reason: reason,
+	})
+}
+
+// validateLabels returns an error if TSDB can not store the label set or
+// Prometheus 2 can not query it.
+func validateLabels(lset model.LabelSet) error {
+	if len(lset) == 0 {
+		return errors.New("series has no labels")
+	}
+
+	for _, l := range convertMetric(model.Metric(lset)) {
+		switch {
+		case !model.LabelName(l.Name).IsValid():
+			return fmt.Errorf("invalid label name %q", l.Name)
+		case l.Value == "":
+			return fmt.Errorf("empty value of label %q", l.Name)
+		case l.Name == string(model.MetricNameLabel) && !model.IsValidMetricName(model.LabelValue(l.Value)):
+			return fmt.Errorf("invalid metric name %q", l.Value)
+		}
+	}
+
+	return nil
+}
+
+// apply returns the relabeled labels of the series with the external labels
+// or nil if the series is dropped.
+func (r *relabeler) apply(m model.Metric) (model.LabelSet, error) {
+	lset := relabel.Process(model.LabelSet(m).Clone(), r.rules.relabelConfigs...)
+	if len(lset) == 0 {
+		return nil, nil
+	}
+
+	for name, value := range r.rules.externalLabels {
+		if existing, ok := lset[name]; ok && existing != value {
+			switch r.rules.conflict {
+			case cfg.LabelConflictKeep:
+				continue
+			case cfg.LabelConflictFail:
+				return nil, fmt.Errorf("label %s=%q conflicts with external label %s=%q", name, existing, name, value)
+			}
+		}
+		lset[name] = value
+	}
+
+	return lset, nil
+}
+
+// Skipped returns the series which are dropped or rejected.
+func (r *relabeler) Skipped() []skippedSeries {
+	return r.skipped
+}
+
+// Process returns the labels of the converted series or false if the series
+// should not be converted.
+func (r *relabeler) Process(m model.Metric) (labels.Labels, bool) {
+	if r.rejected[m.Fingerprint()] {
+		return nil, false
+	}
+
+	if r.rules.empty() {
+		return convertMetric(m), true
+	}
+
+	lset, err := r.apply(m)
+	if err != nil || lset == nil {
+		return nil, false
+	}
+
+	return convertMetric(model.Metric(lset)), true
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	promconfig "github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/storage/metric"
+	cfg "github.com/xperimental/tsdb-migrate/config"
+)
+
+func TestRelabeler(t *testing.T) {
+	// up{instance="1"} has the lower fingerprint.
+	up1 := model.Metric{model.MetricNameLabel: "up", "job": "a", "instance": "1"}
+	up2 := model.Metric{model.MetricNameLabel: "up", "job": "a", "instance": "2"}
+	other := model.Metric{model.MetricNameLabel: "other", "job": "b", "env": "dev"}
+	invalid := model.Metric{model.MetricNameLabel: "invalid-name", "job": "a"}
+
+	dropInstance := &promconfig.RelabelConfig{
+		Action: promconfig.RelabelLabelDrop,
+		Regex:  promconfig.MustNewRegexp("instance"),
+	}
+	dropJobB := &promconfig.RelabelConfig{
+		Action:       promconfig.RelabelDrop,
+		SourceLabels: model.LabelNames{"job"},
+		Regex:        promconfig.MustNewRegexp("b"),
+	}
+	external := model.LabelSet{"env": "prod"}
+
+	for _, test := range []struct {
+		name   string
+		rules  labelRules
+		series []model.Metric
+		// converted contains the labels of every series or nil if the
+		// series is not converted.
+		converted []model.Metric
+		skipped   []skippedSeries
+		err       string
+	}{
+		{
+			name:      "no rules",
+			series:    []model.Metric{up1, up2, other},
+			converted: []model.Metric{up1, up2, other},
+		},
+		{
+			name:      "invalid metric name",
+			series:    []model.Metric{up1, invalid},
+			converted: []model.Metric{up1, nil},
+			skipped:   []skippedSeries{{Labels: invalid.String(), Reason: `invalid metric name "invalid-name"`}},
+		},
+		{
+			name:   "collision",
+			rules:  labelRules{relabelConfigs: []*promconfig.RelabelConfig{dropInstance}},
+			series: []model.Metric{up2, up1, other},
+			converted: []model.Metric{
+				nil,
+				{model.MetricNameLabel: "up", "job": "a"},
+				other,
+			},
+			skipped: []skippedSeries{{Labels: up2.String(), Reason: `relabeled labels {__name__="up", job="a"} collide with series ` + up1.String()}},
+		},
+		{
+			name:      "dropped series",
+			rules:     labelRules{relabelConfigs: []*promconfig.RelabelConfig{dropJobB}},
+			series:    []model.Metric{up1, other},
+			converted: []model.Metric{up1, nil},
+			skipped:   []skippedSeries{{Labels: other.String(), Reason: "dropped by relabeling"}},
+		},
+		{
+			name:   "external labels",
+			rules:  labelRules{externalLabels: external, conflict: cfg.LabelConflictFail},
+			series: []model.Metric{up1},
+			converted: []model.Metric{
+				{model.MetricNameLabel: "up", "job": "a", "instance": "1", "env": "prod"},
+			},
+		},
+		{
+			name:   "conflict fail",
+			rules:  labelRules{externalLabels: external, conflict: cfg.LabelConflictFail},
+			series: []model.Metric{up1, other},
+			err:    `label env="dev" conflicts with external label env="prod"`,
+		},
+		{
+			name:   "conflict overwrite",
+			rules:  labelRules{externalLabels: external, conflict: cfg.LabelConflictOverwrite},
+			series: []model.Metric{up1, other},
+			converted: []model.Metric{
+				{model.MetricNameLabel: "up", "job": "a", "instance": "1", "env": "prod"},
+				{model.MetricNameLabel: "other", "job": "b", "env": "prod"},
+			},
+		},
+		{
+			name:   "conflict keep",
+			rules:  labelRules{externalLabels: external, conflict: cfg.LabelConflictKeep},
+			series: []model.Metric{up1, other},
+			converted: []model.Metric{
+				{model.MetricNameLabel: "up", "job": "a", "instance": "1", "env": "prod"},
+				other,
+			},
+		},
+		{
+			// The overwritten labels of both series are identical.
+			name:   "collision after overwrite",
+			rules:  labelRules{externalLabels: model.LabelSet{"instance": "x"}, conflict: cfg.LabelConflictOverwrite},
+			series: []model.Metric{up1, up2},
+			converted: []model.Metric{
+				{model.MetricNameLabel: "up", "job": "a", "instance": "x"},
+				nil,
+			},
+			skipped: []skippedSeries{{Labels: up2.String(), Reason: `relabeled labels {__name__="up", instance="x", job="a"} collide with series ` + up1.String()}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			series := make([]metric.Metric, 0, len(test.series))
+			for _, m := range test.series {
+				series = append(series, metric.Metric{Metric: m})
+			}
+			sort.Slice(series, func(i, j int) bool {
+				return series[i].Metric.Fingerprint() < series[j].Metric.Fingerprint()
+			})
+
+			r, err := newRelabeler(test.rules, series)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %s", err)
+			}
+
+			for i, m := range test.series {
+				lset, ok := r.Process(m)
+				switch want := test.converted[i]; {
+				case want == nil && ok:
+					t.Errorf("series %s: got labels %s, want it to be skipped", m, lset)
+				case want != nil && !ok:
+					t.Errorf("series %s: skipped, want labels %s", m, want)
+				case want != nil && !reflect.DeepEqual(lset, convertMetric(want)):
+					t.Errorf("series %s: got labels %s, want %s", m, lset, want)
+				}
+			}
+
+			if skipped := r.Skipped(); !reflect.DeepEqual(skipped, test.skipped) {
+				t.Errorf("got skipped series %v, want %v", skipped, test.skipped)
+			}
+		})
+	}
+}
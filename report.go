@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb/labels"
+)
+
+const (
+	statusCompleted   = "completed"
+	statusFailed      = "failed"
+	statusInterrupted = "interrupted"
+)
+
+// report collects statistics about a conversion, which are written to a JSON
+// file at the end of the run.
+type report struct {
+	Input   string    `json:"input"`
+	Output  string    `json:"output"`
+	Mode    string    `json:"mode"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Resumed bool      `json:"resumed"`
+	// ExternalLabels are added to every series, with LabelConflict deciding
+	// about series which already have one of the labels.
+	ExternalLabels model.LabelSet `json:"externalLabels,omitempty"`
+	LabelConflict  string         `json:"labelConflict,omitempty"`
+
+	Status           string    `json:"status"`
+	Error            string    `json:"error,omitempty"`
+	Started          time.Time `json:"started"`
+	Finished         time.Time `json:"finished"`
+	DurationSeconds  float64   `json:"durationSeconds"`
+	Series           int       `json:"series"`
+	Samples          int64     `json:"samples"`
+	SamplesPerSecond float64   `json:"samplesPerSecond"`
+	// BoundaryDuplicates counts samples returned by the input outside of the
+	// window being converted, which would have been converted twice.
+	BoundaryDuplicates int64 `json:"boundaryDuplicates"`
+	// StaleMarkers counts the inserted staleness markers, which are included
+	// in the samples.
+	StaleMarkers int64 `json:"staleMarkers"`
+
+	Windows       []*windowStats          `json:"windows"`
+	Metrics       map[string]*metricStats `json:"metrics"`
+	AppendErrors  map[string]int          `json:"appendErrors"`
+	SkippedSeries []skippedSeries         `json:"skippedSeries"`
+
+	mtx     sync.Mutex
+	windows map[int64]*windowStats
+	seen    map[string]bool
+}
+
+// windowStats contains the series and samples written to one time window.
+type windowStats struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Series  int       `json:"series"`
+	Samples int64     `json:"samples"`
+}
+
+// metricStats contains the series and samples written for one metric name.
+type metricStats struct {
+	Series  int   `json:"series"`
+	Samples int64 `json:"samples"`
+}
+
+// skippedSeries is a series of the input which has not been converted.
+type skippedSeries struct {
+	Labels string `json:"labels"`
+	Reason string `json:"reason"`
+}
+
+func newReport(input, output, mode string, start, end time.Time) *report {
+	return &report{
+		Input:         input,
+		Output:        output,
+		Mode:          mode,
+		Start:         start,
+		End:           end,
+		Started:       time.Now(),
+		Metrics:       make(map[string]*metricStats),
+		AppendErrors:  make(map[string]int),
+		SkippedSeries: []skippedSeries{},
+		windows:       make(map[int64]*windowStats),
+		seen:          make(map[string]bool),
+	}
+}
+
+// AddSamples records samples of a series which have been appended to the
+// window starting at mint.
+func (r *report) AddSamples(mint int64, lset labels.Labels, samples int) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.window(mint).Samples += int64(samples)
+	r.Samples += int64(samples)
+
+	name := lset.Get(string(model.MetricNameLabel))
+	stats, ok := r.Metrics[name]
+	if !ok {
+		stats = &metricStats{}
+		r.Metrics[name] = stats
+	}
+	stats.Samples += int64(samples)
+
+	key := lset.String()
+	if !r.seen[key] {
+		r.seen[key] = true
+		stats.Series++
+		r.Series++
+	}
+}
+
+// AddWindow records the range and number of series of a written window. A
+// window can be written in several parts.
+func (r *report) AddWindow(mint, maxt int64, series int) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	w := r.window(mint)
+	w.Start = timeFromMillis(mint)
+	w.End = timeFromMillis(maxt)
+	w.Series += series
+}
+
+func (r *report) window(start int64) *windowStats {
+	w, ok := r.windows[start]
+	if !ok {
+		w = &windowStats{Start: timeFromMillis(start)}
+		r.windows[start] = w
+	}
+	return w
+}
+
+// AddAppendErrors counts samples which could not be appended.
+func (r *report) AddAppendErrors(reason string, count int) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.AppendErrors[reason] += count
+}
+
+// AddBoundaryDuplicates counts samples which have been dropped because they
+// were outside of the window being converted.
+func (r *report) AddBoundaryDuplicates(count int64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.BoundaryDuplicates += count
+}
+
+// AddStaleMarkers counts the inserted staleness markers.
+func (r *report) AddStaleMarkers(count int64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.StaleMarkers += count
+}
+
+// AddSkipped records series which are not converted.
+func (r *report) AddSkipped(skipped ...skippedSeries) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.SkippedSeries = append(r.SkippedSeries, skipped...)
+}
+
+// Write finishes the report with the status of the run and writes it to path.
+func (r *report) Write(path, status string, err error) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.Status = status
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	r.Finished = time.Now()
+	duration := r.Finished.Sub(r.Started)
+	r.DurationSeconds = duration.Seconds()
+	if duration > 0 {
+		r.SamplesPerSecond = float64(r.Samples) / duration.Seconds()
+	}
+
+	starts := make([]int64, 0, len(r.windows))
+	for start := range r.windows {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	r.Windows = make([]*windowStats, 0, len(starts))
+	for _, start := range starts {
+		r.Windows = append(r.Windows, r.windows[start])
+	}
+
+	b, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, b, 0666)
+}
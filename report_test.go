@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/tsdb/labels"
+	cfg "github.com/xperimental/tsdb-migrate/config"
+)
+
+func TestReportWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsdb-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const hour = int64(time.Hour / time.Millisecond)
+	start, end := timeFromMillis(0), timeFromMillis(4*hour)
+	rep := newReport("data", "output", cfg.ModeTime, start, end)
+
+	upA := labels.FromStrings("__name__", "up", "job", "a")
+	upB := labels.FromStrings("__name__", "up", "job", "b")
+	down := labels.FromStrings("__name__", "down")
+
+	rep.AddSamples(0, upA, 10)
+	rep.AddSamples(0, down, 5)
+	rep.AddWindow(0, 2*hour, 2)
+	// The same series in the next window is only counted once.
+	rep.AddSamples(2*hour, upA, 10)
+	rep.AddSamples(2*hour, upB, 20)
+	rep.AddWindow(2*hour, 4*hour, 2)
+	rep.AddAppendErrors("out_of_order", 3)
+	rep.AddBoundaryDuplicates(4)
+	rep.AddStaleMarkers(2)
+	rep.AddSkipped(skippedSeries{Labels: `{__name__="bad-name"}`, Reason: "invalid metric name"})
+
+	path := filepath.Join(dir, "report.json")
+	if err := rep.Write(path, statusFailed, errors.New("error converting range")); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got struct {
+		Input              string                  `json:"input"`
+		Output             string                  `json:"output"`
+		Mode               string                  `json:"mode"`
+		Start              time.Time               `json:"start"`
+		End                time.Time               `json:"end"`
+		Status             string                  `json:"status"`
+		Error              string                  `json:"error"`
+		Series             int                     `json:"series"`
+		Samples            int64                   `json:"samples"`
+		BoundaryDuplicates int64                   `json:"boundaryDuplicates"`
+		StaleMarkers       int64                   `json:"staleMarkers"`
+		Windows            []windowStats           `json:"windows"`
+		Metrics            map[string]*metricStats `json:"metrics"`
+		AppendErrors       map[string]int          `json:"appendErrors"`
+		SkippedSeries      []skippedSeries         `json:"skippedSeries"`
+	}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("error parsing report: %s", err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"input", got.Input, "data"},
+		{"output", got.Output, "output"},
+		{"mode", got.Mode, cfg.ModeTime},
+		{"start", got.Start.Equal(start), true},
+		{"end", got.End.Equal(end), true},
+		{"status", got.Status, statusFailed},
+		{"error", got.Error, "error converting range"},
+		{"series", got.Series, 3},
+		{"samples", got.Samples, int64(45)},
+		{"boundaryDuplicates", got.BoundaryDuplicates, int64(4)},
+		{"staleMarkers", got.StaleMarkers, int64(2)},
+		{"windows", got.Windows, []windowStats{
+			{Start: timeFromMillis(0), End: timeFromMillis(2 * hour), Series: 2, Samples: 15},
+			{Start: timeFromMillis(2 * hour), End: timeFromMillis(4 * hour), Series: 2, Samples: 30},
+		}},
+		{"metrics", got.Metrics, map[string]*metricStats{
+			"up":   {Series: 2, Samples: 40},
+			"down": {Series: 1, Samples: 5},
+		}},
+		{"appendErrors", got.AppendErrors, map[string]int{"out_of_order": 3}},
+		{"skippedSeries", got.SkippedSeries, []skippedSeries{{Labels: `{__name__="bad-name"}`, Reason: "invalid metric name"}}},
+	} {
+		if !reflect.DeepEqual(test.got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, test.got, test.want)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/nightlyone/lockfile"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+	cfg "github.com/xperimental/tsdb-migrate/config"
+)
+
+const (
+	// throttleCheckSamples is the number of samples appended between checks
+	// whether the 1.x storage needs throttling.
+	throttleCheckSamples = 10000
+	throttleWaitInterval = time.Second
+)
+
+// runReverse copies the series of the TSDB in the output directory back into
+// the 1.x storage in the input directory. The storage is stopped at the end,
+// which writes the checkpoint of the series not persisted yet, also when the
+// copy is interrupted.
+func runReverse(config cfg.MigrateConfig) error {
+	mint, maxt := int64(math.MinInt64), int64(math.MaxInt64)
+	if !config.StartTime.IsZero() {
+		mint = config.StartTime.UnixNano() / 1e6
+	}
+	if !config.EndTime.IsZero() {
+		maxt = config.EndTime.UnixNano()/1e6 - 1
+	}
+
+	log.Printf("Reading TSDB: %s", config.OutputDirectory)
+	db, cleanup, err := openSource(config.OutputDirectory)
+	if err != nil {
+		return fmt.Errorf("error opening output: %s", err)
+	}
+	defer cleanup()
+
+	querier := db.Querier(mint, maxt)
+	defer querier.Close()
+
+	var dl *deadLetter
+	if config.DeadLetterFile != "" {
+		dl, err = openDeadLetter(config.DeadLetterFile, false)
+		if err != nil {
+			return fmt.Errorf("error opening dead-letter file: %s", err)
+		}
+		defer func() {
+			if err := dl.Close(); err != nil {
+				log.Printf("Error closing dead-letter file: %s", err)
+			}
+		}()
+	}
+
+	dir := config.InputDirectories[0]
+	localStorage := openStorage(dir, config.RetentionTime)
+	prometheus.MustRegister(localStorage)
+
+	if config.ListenAddress != "" {
+		go serveMetrics(config.ListenAddress)
+	}
+
+	// TSDB can only select series by a label they have, so all series with a
+	// metric name are copied by default.
+	matcherSets := config.Matchers
+	if len(matcherSets) == 0 {
+		named, err := metric.NewLabelMatcher(metric.RegexMatch, model.MetricNameLabel, ".+")
+		if err != nil {
+			return err
+		}
+		matcherSets = []metric.LabelMatchers{{named}}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- appendReverse(ctx, querier, localStorage, matcherSets, dl)
+	}()
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	var runErr error
+	select {
+	case runErr = <-done:
+	case <-term:
+		log.Printf("Caught interrupt. Exiting...")
+		cancel()
+		// Samples appended after the storage is stopped would be lost.
+		runErr = <-done
+	}
+
+	log.Printf("Stopping local storage %s...", dir)
+	if err := localStorage.Stop(); err != nil {
+		return fmt.Errorf("error stopping local storage: %s", err)
+	}
+
+	return runErr
+}
+
+// openSource opens a copy of the TSDB in dir, so that neither the repair of
+// the WAL nor the truncation of the head change the source. The directory is
+// locked like Prometheus 2 does, which fails while a server is running on it.
+func openSource(dir string) (*tsdb.DB, func(), error) {
+	absdir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	lock, err := lockfile.New(filepath.Join(absdir, "lock"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := lock.TryLock(); err != nil {
+		return nil, nil, fmt.Errorf("error locking %s, Prometheus 2 needs to be stopped: %s", dir, err)
+	}
+	unlock := func() {
+		if err := lock.Unlock(); err != nil {
+			log.Printf("Error unlocking %s: %s", dir, err)
+		}
+	}
+
+	tmp, err := ioutil.TempDir("", "tsdb-migrate-reverse")
+	if err != nil {
+		unlock()
+		return nil, nil, err
+	}
+	removeCopy := func() {
+		if err := os.RemoveAll(tmp); err != nil {
+			log.Printf("Error removing copy of %s: %s", dir, err)
+		}
+		unlock()
+	}
+
+	if err := copySource(absdir, tmp); err != nil {
+		removeCopy()
+		return nil, nil, fmt.Errorf("error copying %s: %s", dir, err)
+	}
+
+	db, err := tsdb.Open(tmp, nil, nil, &tsdb.Options{
+		// Blocks do not need to be aligned to the default chunk range, see
+		// openOutput.
+		BlockRanges: []int64{1},
+		NoLockfile:  true,
+	})
+	if err != nil {
+		removeCopy()
+		return nil, nil, err
+	}
+	db.DisableCompactions()
+
+	return db, func() {
+		if err := db.Close(); err != nil {
+			log.Printf("Error closing output: %s", err)
+		}
+		removeCopy()
+	}, nil
+}
+
+// copySource links the blocks of src into dst and copies the segments of its
+// WAL, which are the only files written when opening a TSDB.
+func copySource(src, dst string) error {
+	dirs, err := blockDirs(src)
+	if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		if err := os.Symlink(d, filepath.Join(dst, filepath.Base(d))); err != nil {
+			return err
+		}
+	}
+
+	segments, err := ioutil.ReadDir(filepath.Join(src, "wal"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(filepath.Join(dst, "wal"), 0777); err != nil {
+		return err
+	}
+	for _, fi := range segments {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		if err := copyFile(filepath.Join(src, "wal", fi.Name()), filepath.Join(dst, "wal", fi.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// appendReverse appends the samples of the selected series to the 1.x
+// storage, one series at a time.
+func appendReverse(ctx context.Context, querier tsdb.Querier, storage *local.MemorySeriesStorage, matcherSets []metric.LabelMatchers, dl *deadLetter) error {
+	started := time.Now()
+	var seriesCount, sampleCount int
+	var throttled time.Duration
+	rejected := make(map[string]int)
+	seen := make(map[string]bool)
+
+	for _, matchers := range matcherSets {
+		set := querier.Select(selectMatchers(matchers)...)
+		for set.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			series := set.At()
+			lset := series.Labels()
+
+			// Series matching several selectors are only copied once and the
+			// matchers not used for selecting are checked here.
+			key := lset.String()
+			if seen[key] || !matchesAny(lset, []metric.LabelMatchers{matchers}) {
+				continue
+			}
+			seen[key] = true
+
+			m := make(model.Metric, len(lset))
+			for _, l := range lset {
+				m[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+			}
+
+			samples := 0
+			it := series.Iterator()
+			for i := 0; it.Next(); i++ {
+				if i%throttleCheckSamples == 0 {
+					waited, err := waitForPersistence(ctx, storage)
+					throttled += waited
+					if err != nil {
+						return err
+					}
+				}
+
+				t, v := it.At()
+				// 1.x has no concept of staleness.
+				if isStaleMarker(model.SampleValue(v)) {
+					continue
+				}
+
+				sample := model.SamplePair{
+					Timestamp: model.Time(t),
+					Value:     model.SampleValue(v),
+				}
+				err := storage.Append(&model.Sample{
+					Metric:    m,
+					Timestamp: sample.Timestamp,
+					Value:     sample.Value,
+				})
+				var reason string
+				switch err {
+				case nil:
+					samples++
+					continue
+				case local.ErrOutOfOrderSample:
+					reason = "out_of_order"
+				case local.ErrDuplicateSampleForTimestamp:
+					reason = "amend"
+				default:
+					return fmt.Errorf("error appending to %s: %s", lset, err)
+				}
+
+				rejected[reason]++
+				if dl == nil {
+					continue
+				}
+				if err := dl.Write(lset, sample, reason); err != nil {
+					return fmt.Errorf("error writing dead letter: %s", err)
+				}
+			}
+			if err := it.Err(); err != nil {
+				return fmt.Errorf("error reading %s: %s", lset, err)
+			}
+
+			seriesCount++
+			sampleCount += samples
+			if seriesCount%1000 == 0 {
+				log.Printf("Appended %d series with %d samples.", seriesCount, sampleCount)
+			}
+		}
+		if err := set.Err(); err != nil {
+			return fmt.Errorf("error selecting series: %s", err)
+		}
+	}
+
+	for reason, count := range rejected {
+		log.Printf("Rejected %d samples: %s", count, reason)
+	}
+	log.Printf("Appended %d series with %d samples in %s (throttled for %s).", seriesCount, sampleCount, time.Since(started).Round(time.Millisecond), throttled.Round(time.Millisecond))
+
+	return nil
+}
+
+// waitForPersistence blocks while the 1.x storage has more chunks waiting for
+// persistence than it can handle and returns the time spent waiting.
+func waitForPersistence(ctx context.Context, storage *local.MemorySeriesStorage) (time.Duration, error) {
+	if !storage.NeedsThrottling() {
+		return 0, nil
+	}
+
+	started := time.Now()
+	ticker := time.NewTicker(throttleWaitInterval)
+	defer ticker.Stop()
+
+	for storage.NeedsThrottling() {
+		select {
+		case <-ctx.Done():
+			return time.Since(started), ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return time.Since(started), nil
+}
+
+// selectMatchers returns the matchers of the selector which do not match
+// series without the label, as TSDB only selects series having the labels of
+// the matchers.
+func selectMatchers(matchers metric.LabelMatchers) []labels.Matcher {
+	var result []labels.Matcher
+	for _, m := range matchers {
+		if m.Match("") {
+			continue
+		}
+		result = append(result, selectorMatcher{m})
+	}
+
+	return result
+}
+
+// selectorMatcher adapts a matcher of a 1.x selector to TSDB.
+type selectorMatcher struct {
+	m *metric.LabelMatcher
+}
+
+func (s selectorMatcher) Name() string {
+	return string(s.m.Name)
+}
+
+func (s selectorMatcher) Matches(v string) bool {
+	return s.m.Match(model.LabelValue(v))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// listFiles returns the sizes of the files in dir by their relative path.
+func listFiles(t *testing.T, dir string) map[string]int64 {
+	files := make(map[string]int64)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[rel] = fi.Size()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestOpenSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsdb-migrate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Opening a TSDB replays and repairs its WAL.
+	db, err := tsdb.Open(dir, nil, nil, &tsdb.Options{BlockRanges: []int64{3600000}, NoLockfile: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := db.Appender()
+	lset := labels.FromStrings("__name__", "up", "job", "a")
+	for ts := int64(0); ts < 3; ts++ {
+		if _, err := app.Add(lset, ts*15000, float64(ts)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := app.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	before := listFiles(t, dir)
+
+	source, cleanup, err := openSource(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "lock")); err != nil {
+		t.Errorf("source not locked: %s", err)
+	}
+
+	app = source.Appender()
+	if _, err := app.Add(lset, 60000, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+
+	if after := listFiles(t, dir); !reflect.DeepEqual(after, before) {
+		t.Errorf("source changed: got %v, want %v", after, before)
+	}
+}
+
+func TestOpenSourceRunning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsdb-migrate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The parent process stands in for a running Prometheus 2.
+	if err := ioutil.WriteFile(filepath.Join(dir, "lock"), []byte(strconv.Itoa(os.Getppid())+"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = openSource(dir)
+	if err == nil || !strings.Contains(err.Error(), "needs to be stopped") {
+		t.Errorf("got error %v, want locked", err)
+	}
+}
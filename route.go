@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/tsdb/labels"
+	cfg "github.com/xperimental/tsdb-migrate/config"
+)
+
+// router assigns every series to an output directory relative to the output
+// root, either by filling the labels of the series into a template or by the
+// first matching route.
+type router struct {
+	template string
+	routes   []cfg.Route
+	fallback string
+
+	mtx sync.Mutex
+	// values contains the label values filled into the template for every
+	// directory, to detect different values mapped to the same directory.
+	values map[string]string
+}
+
+// newRouter returns nil if the output is not split.
+func newRouter(config cfg.MigrateConfig) *router {
+	if !config.Split() {
+		return nil
+	}
+
+	return &router{
+		template: config.OutputTemplate,
+		routes:   config.Routes,
+		fallback: config.RouteDefault,
+		values:   make(map[string]string),
+	}
+}
+
+// Output returns the directory of the series or false if the series is not
+// routed anywhere. It returns an error if the label values of the series map
+// to the same directory as different values of an earlier series.
+func (r *router) Output(lset labels.Labels) (string, bool, error) {
+	if r.template != "" {
+		missing := false
+		var values labels.Labels
+		dir := cfg.PlaceholderPattern.ReplaceAllStringFunc(r.template, func(placeholder string) string {
+			name := cfg.PlaceholderPattern.FindStringSubmatch(placeholder)[1]
+			value := lset.Get(name)
+			if value == "" {
+				missing = true
+			}
+			values = append(values, labels.Label{Name: name, Value: value})
+			return pathSegment(value)
+		})
+
+		if !missing {
+			if err := r.checkCollision(dir, values.String()); err != nil {
+				return "", false, err
+			}
+			return dir, true, nil
+		}
+	}
+
+	for _, route := range r.routes {
+		if matchesAny(lset, []metric.LabelMatchers{route.Matchers}) {
+			return route.Directory, true, nil
+		}
+	}
+
+	return r.fallback, r.fallback != "", nil
+}
+
+// checkCollision records the label values of a directory and returns an error
+// if the directory has been used for different values before.
+func (r *router) checkCollision(dir, values string) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	previous, ok := r.values[dir]
+	if !ok {
+		r.values[dir] = values
+		return nil
+	}
+
+	if previous != values {
+		return fmt.Errorf("label values %s and %s are both written to directory %s", previous, values, dir)
+	}
+	return nil
+}
+
+// pathSegment replaces the characters of a label value which are not safe in
+// a directory name.
+func pathSegment(value string) string {
+	if value == "." || value == ".." {
+		return "_"
+	}
+
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, value)
+}
+
+// sampleWriter collects the samples of a window or batch until they are
+// flushed. It is implemented by blockWriter and splitWriter.
+type sampleWriter interface {
+	Append(lset labels.Labels, samples []model.SamplePair) error
+	Flush() error
+	Discard()
+	SetWidth(width int64)
+}
+
+// newSampleWriter returns a block writer for the output directory or, if the
+// router is set, a writer splitting the series into several directories. The
+// blocks are written to subdir of the output directories. The output
+// directories must not contain blocks overlapping the windows of the samples
+// from mint up to, but not including, maxt.
+func newSampleWriter(outputDir, subdir string, router *router, width, mint, maxt int64, rep *report, dl *deadLetter) (sampleWriter, error) {
+	if router == nil {
+		dir := filepath.Join(outputDir, subdir)
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return nil, err
+		}
+
+		return newBlockWriter(dir, width, prometheus.DefaultRegisterer, rep, dl)
+	}
+
+	mint, maxt = alignRange(mint, maxt, width)
+
+	return &splitWriter{
+		router:     router,
+		root:       outputDir,
+		subdir:     subdir,
+		width:      width,
+		mint:       mint,
+		maxt:       maxt,
+		report:     rep,
+		deadLetter: dl,
+		writers:    make(map[string]*blockWriter),
+		skipped:    make(map[string]bool),
+	}, nil
+}
+
+// splitWriter routes the series to one block writer per output directory. The
+// writers are created when the first series of a directory is appended.
+type splitWriter struct {
+	router     *router
+	root       string
+	subdir     string
+	mint       int64
+	maxt       int64
+	report     *report
+	deadLetter *deadLetter
+
+	mtx     sync.Mutex
+	width   int64
+	writers map[string]*blockWriter
+	skipped map[string]bool
+}
+
+// Append adds the samples of one series to the writer of its directory.
+// Series without a directory are skipped.
+func (w *splitWriter) Append(lset labels.Labels, samples []model.SamplePair) error {
+	dir, ok, err := w.router.Output(lset)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		w.skip(lset)
+		return nil
+	}
+
+	writer, err := w.writer(dir)
+	if err != nil {
+		return err
+	}
+
+	return writer.Append(lset, samples)
+}
+
+func (w *splitWriter) writer(dir string) (*blockWriter, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if writer, ok := w.writers[dir]; ok {
+		return writer, nil
+	}
+
+	output := filepath.Join(w.root, dir)
+	if err := os.MkdirAll(filepath.Join(output, w.subdir), 0777); err != nil {
+		return nil, fmt.Errorf("error creating output directory: %s", err)
+	}
+
+	if err := checkOverlap(output, w.mint, w.maxt); err != nil {
+		return nil, fmt.Errorf("error checking output %s: %s", output, err)
+	}
+
+	// NewLeveledCompactor registers its collectors with MustRegister, which
+	// panics when a second compactor is registered with the same registerer,
+	// so every directory has its own registry.
+	writer, err := newBlockWriter(filepath.Join(output, w.subdir), w.width, outputMetrics.Registerer(dir), w.report, w.deadLetter)
+	if err != nil {
+		return nil, err
+	}
+	w.writers[dir] = writer
+	log.Printf("Writing blocks to: %s", output)
+
+	return writer, nil
+}
+
+func (w *splitWriter) skip(lset labels.Labels) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	key := lset.String()
+	if w.skipped[key] {
+		return
+	}
+	w.skipped[key] = true
+
+	log.Printf("Skipping series %s: no output matches", lset)
+	w.report.AddSkipped(skippedSeries{
+		Labels: key,
+		Reason: "no output matches",
+	})
+}
+
+// Flush writes the collected windows of every directory.
+func (w *splitWriter) Flush() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	dirs := make([]string, 0, len(w.writers))
+	for dir := range w.writers {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		if err := w.writers[dir].Flush(); err != nil {
+			return fmt.Errorf("error writing %s: %s", dir, err)
+		}
+	}
+
+	return nil
+}
+
+// Discard drops the collected windows of every directory.
+func (w *splitWriter) Discard() {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	for _, writer := range w.writers {
+		writer.Discard()
+	}
+}
+
+// SetWidth changes the width of the windows of every directory.
+func (w *splitWriter) SetWidth(width int64) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.width = width
+	for _, writer := range w.writers {
+		writer.SetWidth(width)
+	}
+}
+
+// outputDirs returns the output directories below root which contain blocks
+// or staged blocks. Without a split output, this is only root.
+func outputDirs(root string, split bool) ([]string, error) {
+	if !split {
+		return []string{filepath.Clean(root)}, nil
+	}
+
+	found := make(map[string]bool)
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() || path == root {
+			return nil
+		}
+
+		name := fi.Name()
+		if _, err := ulid.Parse(strings.TrimSuffix(name, ".tmp")); err == nil || name == stagingDirName {
+			found[filepath.Dir(path)] = true
+			return filepath.SkipDir
+		}
+		if name == "wal" {
+			return filepath.SkipDir
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := make([]string, 0, len(found))
+	for dir := range found {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	return dirs, nil
+}
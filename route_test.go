@@ -0,0 +1,181 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/tsdb/labels"
+	cfg "github.com/xperimental/tsdb-migrate/config"
+)
+
+func TestPathSegment(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  string
+	}{
+		{value: "team-a.1_b", want: "team-a.1_b"},
+		{value: "team/a", want: "team_a"},
+		{value: "team a", want: "team_a"},
+		{value: "äb", want: "_b"},
+		{value: ".", want: "_"},
+		{value: "..", want: "_"},
+		{value: "...", want: "..."},
+	} {
+		if got := pathSegment(test.value); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestRouterOutput(t *testing.T) {
+	mustMatcher := func(name model.LabelName, value model.LabelValue) *metric.LabelMatcher {
+		m, err := metric.NewLabelMatcher(metric.Equal, name, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	routes := []cfg.Route{
+		{Directory: "prod", Matchers: metric.LabelMatchers{mustMatcher("env", "prod")}},
+		{Directory: "up", Matchers: metric.LabelMatchers{mustMatcher(model.MetricNameLabel, "up")}},
+	}
+
+	for _, test := range []struct {
+		name   string
+		config cfg.MigrateConfig
+		// series are routed in order, the last one is checked.
+		series []labels.Labels
+		dir    string
+		ok     bool
+		err    string
+	}{
+		{
+			name:   "template",
+			config: cfg.MigrateConfig{OutputTemplate: "{{team}}/{{env}}"},
+			series: []labels.Labels{labels.FromStrings("team", "a/b", "env", "prod")},
+			dir:    "a_b/prod",
+			ok:     true,
+		},
+		{
+			name:   "missing label without default",
+			config: cfg.MigrateConfig{OutputTemplate: "{{team}}/{{env}}"},
+			series: []labels.Labels{labels.FromStrings("team", "a")},
+		},
+		{
+			name:   "missing label with default",
+			config: cfg.MigrateConfig{OutputTemplate: "{{team}}", RouteDefault: "other"},
+			series: []labels.Labels{labels.FromStrings("env", "prod")},
+			dir:    "other",
+			ok:     true,
+		},
+		{
+			name:   "same values",
+			config: cfg.MigrateConfig{OutputTemplate: "{{team}}"},
+			series: []labels.Labels{
+				labels.FromStrings("team", "a", "job", "1"),
+				labels.FromStrings("team", "a", "job", "2"),
+			},
+			dir: "a",
+			ok:  true,
+		},
+		{
+			name:   "collision",
+			config: cfg.MigrateConfig{OutputTemplate: "{{team}}"},
+			series: []labels.Labels{
+				labels.FromStrings("team", "a_b"),
+				labels.FromStrings("team", "a/b"),
+			},
+			err: `label values {team="a_b"} and {team="a/b"} are both written to directory a_b`,
+		},
+		{
+			name:   "collision of several labels",
+			config: cfg.MigrateConfig{OutputTemplate: "{{team}}-{{env}}"},
+			series: []labels.Labels{
+				labels.FromStrings("team", "a-b", "env", "c"),
+				labels.FromStrings("team", "a", "env", "b-c"),
+			},
+			err: "are both written to directory a-b-c",
+		},
+		{
+			name:   "first matching route",
+			config: cfg.MigrateConfig{Routes: routes},
+			series: []labels.Labels{labels.FromStrings(model.MetricNameLabel, "up", "env", "prod")},
+			dir:    "prod",
+			ok:     true,
+		},
+		{
+			name:   "second route",
+			config: cfg.MigrateConfig{Routes: routes},
+			series: []labels.Labels{labels.FromStrings(model.MetricNameLabel, "up", "env", "dev")},
+			dir:    "up",
+			ok:     true,
+		},
+		{
+			name:   "no route",
+			config: cfg.MigrateConfig{Routes: routes},
+			series: []labels.Labels{labels.FromStrings(model.MetricNameLabel, "down")},
+		},
+		{
+			name:   "default route",
+			config: cfg.MigrateConfig{Routes: routes, RouteDefault: "other"},
+			series: []labels.Labels{labels.FromStrings(model.MetricNameLabel, "down")},
+			dir:    "other",
+			ok:     true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := newRouter(test.config)
+
+			var dir string
+			var ok bool
+			var err error
+			for _, lset := range test.series {
+				dir, ok, err = r.Output(lset)
+			}
+
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error: %s", err)
+			}
+
+			if dir != test.dir || ok != test.ok {
+				t.Errorf("got %q (%t), want %q (%t)", dir, ok, test.dir, test.ok)
+			}
+		})
+	}
+}
+
+func TestOutputMetrics(t *testing.T) {
+	g := &dirGatherer{registries: make(map[string]*prometheus.Registry)}
+	for _, dir := range []string{"a", "b"} {
+		counter := prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "test_total",
+			Help: "Test counter.",
+		})
+		g.Registerer(dir).MustRegister(counter)
+		counter.Inc()
+	}
+
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mfs) != 1 || len(mfs[0].Metric) != 2 {
+		t.Fatalf("got metric families %v, want one with two metrics", mfs)
+	}
+	for i, m := range mfs[0].Metric {
+		want := []string{"a", "b"}[i]
+		if len(m.Label) != 1 || m.Label[0].GetName() != "dir" || m.Label[0].GetValue() != want {
+			t.Errorf("got labels %v, want dir=%q", m.Label, want)
+		}
+	}
+}
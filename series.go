@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// errBatchTooLarge is returned when a batch of series exceeds the sample limit.
+var errBatchTooLarge = errors.New("batch too large")
+
+// runConvertSeries converts the input one batch of series at a time. It
+// returns the error of the context if the conversion is interrupted.
+func runConvertSeries(ctx context.Context, input inputStorage, cp *checkpoint, outputDir string, start, end time.Time, step time.Duration, batchSize int, maxBatchSamples int64, matcherSets []metric.LabelMatchers, rules labelRules, router *router, st *staleness, workers int, rep *report, dl *deadLetter) error {
+	modelStart := model.TimeFromUnixNano(start.UnixNano())
+	modelEnd := model.TimeFromUnixNano(end.UnixNano())
+
+	metrics, err := listSeries(ctx, input, modelStart, modelEnd-1, matcherSets)
+	if err != nil {
+		return fmt.Errorf("error listing series: %s", err)
+	}
+	log.Printf("Found %d series.", len(metrics))
+	relabeler, err := newRelabeler(rules, metrics)
+	if err != nil {
+		return fmt.Errorf("error applying labels: %s", err)
+	}
+	rep.AddSkipped(relabeler.Skipped()...)
+
+	if last, ok := cp.Fingerprint(); ok {
+		skip := sort.Search(len(metrics), func(i int) bool {
+			return metrics[i].Metric.Fingerprint() > last
+		})
+		log.Printf("Skipping %d completed series.", skip)
+		metrics = metrics[skip:]
+	}
+
+	width := int64(step / time.Millisecond)
+	writer, err := newSampleWriter(outputDir, stagingDirName, router, width, int64(modelStart), int64(modelEnd), rep, dl)
+	if err != nil {
+		return fmt.Errorf("error creating block writer: %s", err)
+	}
+
+	for len(metrics) > 0 && ctx.Err() == nil {
+		batch := metrics
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+
+		fps := make([]model.Fingerprint, len(batch))
+		for i, m := range batch {
+			fps[i] = m.Metric.Fingerprint()
+		}
+
+		var seriesCount, sampleCount, outsideCount, markerCount int64
+		err := shardByFingerprint(workers, fps, func(i int) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			m := batch[i].Metric
+			lset, ok := relabeler.Process(m)
+			if !ok {
+				return nil
+			}
+
+			samples, outside, markers, err := convertSeries(ctx, writer, input, m, lset, modelStart, modelEnd, step, st)
+			if err != nil {
+				return fmt.Errorf("error converting series %s: %s", m, err)
+			}
+			total := atomic.AddInt64(&sampleCount, int64(samples))
+			atomic.AddInt64(&outsideCount, int64(outside))
+			atomic.AddInt64(&markerCount, int64(markers))
+			atomic.AddInt64(&seriesCount, 1)
+
+			// A batch of a single series is converted regardless of the limit.
+			if maxBatchSamples > 0 && len(batch) > 1 && total > maxBatchSamples {
+				return errBatchTooLarge
+			}
+			return nil
+		})
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case err == errBatchTooLarge:
+			writer.Discard()
+			runtime.GC()
+
+			batchSize = len(batch) / 2
+			log.Printf("Batch starting at series %s has more than %d samples, reducing batch size to %d", fps[0], maxBatchSamples, batchSize)
+			continue
+		case err != nil:
+			return fmt.Errorf("error converting batch: %s", err)
+		}
+		metrics = metrics[len(batch):]
+
+		if err := writer.Flush(); err != nil {
+			return fmt.Errorf("error writing blocks: %s", err)
+		}
+		seriesConverted.Add(float64(seriesCount))
+		rep.AddBoundaryDuplicates(outsideCount)
+		rep.AddStaleMarkers(markerCount)
+
+		last := batch[len(batch)-1].Metric.Fingerprint()
+		if err := cp.SaveSeries(last); err != nil {
+			return fmt.Errorf("error saving checkpoint: %s", err)
+		}
+		batchesConverted.Inc()
+
+		log.Printf("FP: %s Metrics: %d Samples: %d", last, len(batch), sampleCount)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := mergeOutputs(outputDir, router != nil, width); err != nil {
+		return err
+	}
+
+	if err := cp.Remove(); err != nil {
+		log.Printf("Error removing checkpoint: %s", err)
+	}
+
+	return nil
+}
+
+// convertSeries copies the history of a single series between start and end
+// (exclusive) into the writer. The history is read one step at a time to keep
+// the number of decoded samples low. It returns the number of converted samples,
+// of samples outside of the steps returned by the input and of inserted
+// staleness markers.
+func convertSeries(ctx context.Context, writer sampleWriter, input inputStorage, m model.Metric, lset labels.Labels, start, end model.Time, step time.Duration, st *staleness) (int, int, int, error) {
+	read := metric.Interval{
+		OldestInclusive: start,
+		NewestInclusive: end - 1,
+	}
+	if st != nil {
+		read = st.readInterval(read)
+	}
+
+	iterator, err := querySeries(ctx, input, read.OldestInclusive, read.NewestInclusive, m)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("error during query: %s", err)
+	}
+	if iterator == nil {
+		return 0, 0, 0, nil
+	}
+	defer iterator.Close()
+
+	sampleCount, outsideCount, markerCount := 0, 0, 0
+	for t := start; t.Before(end); t = t.Add(step) {
+		next := t.Add(step)
+		if next.After(end) {
+			next = end
+		}
+
+		interval := metric.Interval{
+			OldestInclusive: t,
+			NewestInclusive: next - 1,
+		}
+
+		samples, outside, markers, err := readSamples(iterator, interval, st)
+		if err != nil {
+			return sampleCount, outsideCount, markerCount, err
+		}
+		outsideCount += outside
+		markerCount += markers
+		if err := writer.Append(lset, samples); err != nil {
+			return sampleCount, outsideCount, markerCount, err
+		}
+		sampleCount += len(samples)
+	}
+
+	return sampleCount, outsideCount, markerCount, nil
+}
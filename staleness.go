@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+const (
+	// staleNaN is the value of the staleness markers written by Prometheus 2.
+	staleNaN uint64 = 0x7ff0000000000002
+
+	// stalenessDelta is how long PromQL uses a sample without newer samples.
+	// Series scraped less often disappear before the next scrape anyway and
+	// do not need markers.
+	stalenessDelta = 5 * time.Minute
+)
+
+// staleness inserts staleness markers after the last sample of a series and
+// after gaps longer than gapFactor times the scrape interval of the series.
+// The scrape interval is inferred from the samples around the converted
+// interval, so the samples are read with a margin before and after it.
+type staleness struct {
+	gapFactor float64
+	margin    model.Time
+}
+
+// newStaleness returns nil if no markers should be inserted.
+func newStaleness(enabled bool, gapFactor float64) *staleness {
+	if !enabled {
+		return nil
+	}
+
+	return &staleness{
+		gapFactor: gapFactor,
+		margin:    model.Time(gapFactor * float64(stalenessDelta/time.Millisecond)),
+	}
+}
+
+// readInterval returns the interval including the margins.
+func (s *staleness) readInterval(interval metric.Interval) metric.Interval {
+	return metric.Interval{
+		OldestInclusive: interval.OldestInclusive - s.margin,
+		NewestInclusive: interval.NewestInclusive + s.margin,
+	}
+}
+
+// markers returns the staleness markers inside the interval for the samples
+// read from the readInterval of it.
+func (s *staleness) markers(samples []model.SamplePair, interval metric.Interval) []model.SamplePair {
+	step, ok := scrapeInterval(samples)
+	if !ok || step >= model.Time(stalenessDelta/time.Millisecond) {
+		return nil
+	}
+
+	readEnd := s.readInterval(interval).NewestInclusive
+	maxGap := model.Time(s.gapFactor * float64(step))
+
+	var markers []model.SamplePair
+	for i, sample := range samples {
+		if i+1 < len(samples) {
+			if samples[i+1].Timestamp-sample.Timestamp <= maxGap {
+				continue
+			}
+		} else if sample.Timestamp+maxGap > readEnd {
+			// The next sample might be after the samples read.
+			continue
+		}
+
+		t := sample.Timestamp + step
+		if t.Before(interval.OldestInclusive) || t.After(interval.NewestInclusive) {
+			continue
+		}
+
+		markers = append(markers, model.SamplePair{
+			Timestamp: t,
+			Value:     model.SampleValue(math.Float64frombits(staleNaN)),
+		})
+	}
+
+	return markers
+}
+
+// scrapeInterval returns the median distance between the samples.
+func scrapeInterval(samples []model.SamplePair) (model.Time, bool) {
+	if len(samples) < 2 {
+		return 0, false
+	}
+
+	deltas := make([]model.Time, 0, len(samples)-1)
+	for i := 1; i < len(samples); i++ {
+		deltas = append(deltas, samples[i].Timestamp-samples[i-1].Timestamp)
+	}
+	sort.Slice(deltas, func(i, j int) bool { return deltas[i] < deltas[j] })
+
+	return deltas[len(deltas)/2], true
+}
+
+// isStaleMarker returns true if the value is a staleness marker.
+func isStaleMarker(v model.SampleValue) bool {
+	return math.Float64bits(float64(v)) == staleNaN
+}
+
+// readSamples returns the samples of the iterator inside the interval, the
+// number of samples outside of it returned by the input and the number of
+// inserted staleness markers.
+func readSamples(iterator local.SeriesIterator, interval metric.Interval, st *staleness) ([]model.SamplePair, int, int, error) {
+	if st == nil {
+		samples, outside := samplesInInterval(iterator.RangeValues(interval), interval)
+		return samples, outside, 0, iteratorErr(iterator)
+	}
+
+	read := st.readInterval(interval)
+	all, outside := samplesInInterval(iterator.RangeValues(read), read)
+	if err := iteratorErr(iterator); err != nil {
+		return nil, 0, 0, err
+	}
+	samples, _ := samplesInInterval(all, interval)
+
+	markers := st.markers(all, interval)
+	if len(markers) == 0 {
+		return samples, outside, 0, nil
+	}
+
+	return mergeSorted(samples, markers), outside, len(markers), nil
+}
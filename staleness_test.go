@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// scrapes returns samples every step from start up to and including end.
+func scrapes(start, end, step model.Time) []model.SamplePair {
+	var result []model.SamplePair
+	for t := start; t <= end; t += step {
+		result = append(result, model.SamplePair{Timestamp: t, Value: 1})
+	}
+	return result
+}
+
+func marker(t model.Time) model.SamplePair {
+	return model.SamplePair{Timestamp: t, Value: model.SampleValue(math.Float64frombits(staleNaN))}
+}
+
+// equalSamples compares the values bitwise, so stale markers are equal.
+func equalSamples(a, b []model.SamplePair) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Timestamp != b[i].Timestamp || math.Float64bits(float64(a[i].Value)) != math.Float64bits(float64(b[i].Value)) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestScrapeInterval(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		samples []model.SamplePair
+		want    model.Time
+		ok      bool
+	}{
+		{name: "empty"},
+		{name: "single sample", samples: scrapes(0, 0, 1)},
+		{name: "two samples", samples: scrapes(0, 15, 15), want: 15, ok: true},
+		{name: "median ignores gap", samples: samples(0, 1, 15, 1, 30, 1, 100, 1), want: 15, ok: true},
+		{name: "upper median", samples: samples(0, 1, 10, 1, 30, 1), want: 20, ok: true},
+	} {
+		got, ok := scrapeInterval(test.samples)
+		if got != test.want || ok != test.ok {
+			t.Errorf("%s: got %d (%t), want %d (%t)", test.name, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestStalenessMarkers(t *testing.T) {
+	st := newStaleness(true, 2)
+	if st.margin != 600000 {
+		t.Fatalf("got margin %d, want 600000", st.margin)
+	}
+
+	hour := metric.Interval{OldestInclusive: 0, NewestInclusive: 3599999}
+	for _, test := range []struct {
+		name     string
+		samples  []model.SamplePair
+		interval metric.Interval
+		want     []model.SamplePair
+	}{
+		{
+			name:     "series end",
+			samples:  scrapes(0, 60000, 15000),
+			interval: hour,
+			want:     []model.SamplePair{marker(75000)},
+		},
+		{
+			name:     "continuous series",
+			samples:  scrapes(-600000, 4199999, 15000),
+			interval: hour,
+		},
+		{
+			// The next sample might be after the samples read.
+			name:     "end close to read interval",
+			samples:  scrapes(3600000, 4185000, 15000),
+			interval: hour,
+		},
+		{
+			name:     "gap",
+			samples:  samples(0, 1, 15000, 1, 30000, 1, 100000, 1, 115000, 1),
+			interval: hour,
+			want:     []model.SamplePair{marker(45000), marker(130000)},
+		},
+		{
+			name:     "gap at factor",
+			samples:  samples(0, 1, 15000, 1, 30000, 1, 60000, 1, 75000, 1, 90000, 1),
+			interval: hour,
+			want:     []model.SamplePair{marker(105000)},
+		},
+		{
+			name:     "marker before interval",
+			samples:  scrapes(0, 60000, 15000),
+			interval: metric.Interval{OldestInclusive: 100000, NewestInclusive: 199999},
+		},
+		{
+			name:     "marker at interval end",
+			samples:  scrapes(0, 60000, 15000),
+			interval: metric.Interval{OldestInclusive: 0, NewestInclusive: 75000},
+			want:     []model.SamplePair{marker(75000)},
+		},
+		{
+			name:     "marker after interval",
+			samples:  scrapes(0, 60000, 15000),
+			interval: metric.Interval{OldestInclusive: 0, NewestInclusive: 74999},
+		},
+		{
+			name:     "slow series",
+			samples:  scrapes(0, 600000, 300000),
+			interval: hour,
+		},
+		{
+			name:     "single sample",
+			samples:  scrapes(0, 0, 1),
+			interval: hour,
+		},
+		{
+			name:     "empty",
+			interval: hour,
+		},
+	} {
+		got := st.markers(test.samples, test.interval)
+		if !equalSamples(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// sliceIterator returns the samples of a slice and err from Err.
+type sliceIterator struct {
+	metric  model.Metric
+	samples []model.SamplePair
+	err     error
+}
+
+func (it *sliceIterator) ValueAtOrBeforeTime(t model.Time) model.SamplePair {
+	result := model.ZeroSamplePair
+	for _, s := range it.samples {
+		if s.Timestamp.After(t) {
+			break
+		}
+		result = s
+	}
+	return result
+}
+
+func (it *sliceIterator) RangeValues(in metric.Interval) []model.SamplePair {
+	var result []model.SamplePair
+	for _, s := range it.samples {
+		if !s.Timestamp.Before(in.OldestInclusive) && !s.Timestamp.After(in.NewestInclusive) {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func (it *sliceIterator) Err() error {
+	return it.err
+}
+
+func (it *sliceIterator) Metric() metric.Metric {
+	return metric.Metric{Metric: it.metric}
+}
+
+func (it *sliceIterator) Close() {}
+
+func TestReadSamples(t *testing.T) {
+	it := &sliceIterator{samples: scrapes(0, 60000, 15000)}
+	interval := metric.Interval{OldestInclusive: 30000, NewestInclusive: 99999}
+
+	got, outside, markers, err := readSamples(it, interval, nil)
+	if want := scrapes(30000, 60000, 15000); err != nil || !equalSamples(got, want) || outside != 0 || markers != 0 {
+		t.Errorf("without markers: got %v (%d outside, %d markers, error %v), want %v", got, outside, markers, err, want)
+	}
+
+	got, outside, markers, err = readSamples(it, interval, newStaleness(true, 2))
+	if want := append(scrapes(30000, 60000, 15000), marker(75000)); err != nil || !equalSamples(got, want) || outside != 0 || markers != 1 {
+		t.Errorf("with markers: got %v (%d outside, %d markers, error %v), want %v", got, outside, markers, err, want)
+	}
+
+	it.err = errors.New("corrupt chunk")
+	for _, st := range []*staleness{nil, newStaleness(true, 2)} {
+		if _, _, _, err := readSamples(it, interval, st); err != it.err {
+			t.Errorf("staleness %v: got error %v, want %v", st != nil, err, it.err)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// verifyResult counts the differences between the input and the output.
+type verifyResult struct {
+	series          int
+	samples         int
+	missingSeries   int
+	extraSeries     int
+	missingSamples  int
+	extraSamples    int
+	mismatchSamples int
+}
+
+func (r verifyResult) differences() int {
+	return r.missingSeries + r.extraSeries + r.missingSamples + r.extraSamples + r.mismatchSamples
+}
+
+// runVerify compares the samples of every series in the input with the
+// converted series in the output directory. With a split output, every series
+// is compared with the database of its directory.
+func runVerify(ctx context.Context, input inputStorage, outputDir string, start, end time.Time, matcherSets []metric.LabelMatchers, rules labelRules, router *router) error {
+	interval := metric.Interval{
+		OldestInclusive: model.TimeFromUnixNano(start.UnixNano()),
+		NewestInclusive: model.TimeFromUnixNano(end.UnixNano()) - 1,
+	}
+
+	metrics, err := listSeries(ctx, input, interval.OldestInclusive, interval.NewestInclusive, matcherSets)
+	if err != nil {
+		return fmt.Errorf("error listing series: %s", err)
+	}
+	log.Printf("Verifying %d series.", len(metrics))
+	relabeler, err := newRelabeler(rules, metrics)
+	if err != nil {
+		return fmt.Errorf("error applying labels: %s", err)
+	}
+
+	queriers := newOutputQueriers(int64(interval.OldestInclusive), int64(interval.NewestInclusive))
+	defer queriers.Close()
+
+	var result verifyResult
+	seen := make(map[string]map[string]bool)
+	for _, m := range metrics {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		lset, ok := relabeler.Process(m.Metric)
+		if !ok {
+			continue
+		}
+
+		dir := filepath.Clean(outputDir)
+		if router != nil {
+			dest, ok, err := router.Output(lset)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			dir = filepath.Join(outputDir, dest)
+		}
+
+		if seen[dir] == nil {
+			seen[dir] = make(map[string]bool)
+		}
+		seen[dir][lset.String()] = true
+
+		expected, err := inputSamples(ctx, input, m.Metric, interval)
+		if err != nil {
+			return fmt.Errorf("error reading series %s: %s", m.Metric, err)
+		}
+
+		querier, err := queriers.Get(dir)
+		if err != nil {
+			return fmt.Errorf("error opening output %s: %s", dir, err)
+		}
+
+		var actual []model.SamplePair
+		found := false
+		if querier != nil {
+			actual, found, err = outputSamples(querier, lset)
+			if err != nil {
+				return fmt.Errorf("error reading series %s from output: %s", lset, err)
+			}
+		}
+
+		result.series++
+		result.samples += len(expected)
+
+		if !found {
+			if len(expected) > 0 {
+				log.Printf("Missing series %s with %d samples", lset, len(expected))
+				result.missingSeries++
+				result.missingSamples += len(expected)
+			}
+			continue
+		}
+
+		missing, extra, mismatch, first := compareSamples(expected, actual)
+		if missing+extra+mismatch > 0 {
+			log.Printf("Series %s: %d missing, %d extra and %d mismatched samples (first difference at %s)", lset, missing, extra, mismatch, first.Time().UTC())
+			result.missingSamples += missing
+			result.extraSamples += extra
+			result.mismatchSamples += mismatch
+		}
+	}
+
+	dirs, err := outputDirs(outputDir, router != nil)
+	if err != nil {
+		return fmt.Errorf("error listing outputs: %s", err)
+	}
+
+	for _, dir := range dirs {
+		output, err := outputSeries(dir, int64(interval.OldestInclusive), int64(interval.NewestInclusive))
+		if err != nil {
+			return fmt.Errorf("error listing output series: %s", err)
+		}
+
+		for _, lset := range output {
+			if seen[dir][lset.String()] || !matchesAny(lset, matcherSets) {
+				continue
+			}
+
+			log.Printf("Extra series %s in %s", lset, dir)
+			result.extraSeries++
+		}
+	}
+
+	log.Printf("Verified %d series with %d samples.", result.series, result.samples)
+	if result.differences() > 0 {
+		return fmt.Errorf("output differs from input: %d missing series, %d extra series, %d missing samples, %d extra samples, %d mismatched values",
+			result.missingSeries, result.extraSeries, result.missingSamples, result.extraSamples, result.mismatchSamples)
+	}
+
+	log.Println("Output matches input.")
+	return nil
+}
+
+// outputQueriers opens the databases of the output directories when they are
+// first queried.
+type outputQueriers struct {
+	mint     int64
+	maxt     int64
+	queriers map[string]tsdb.Querier
+	closers  []func()
+}
+
+func newOutputQueriers(mint, maxt int64) *outputQueriers {
+	return &outputQueriers{
+		mint:     mint,
+		maxt:     maxt,
+		queriers: make(map[string]tsdb.Querier),
+	}
+}
+
+// Get returns a querier for the database in dir or nil if the directory does
+// not exist.
+func (o *outputQueriers) Get(dir string) (tsdb.Querier, error) {
+	if querier, ok := o.queriers[dir]; ok {
+		return querier, nil
+	}
+
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		o.queriers[dir] = nil
+		return nil, nil
+	}
+
+	db, cleanup, err := openOutput(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	querier := db.Querier(o.mint, o.maxt)
+	o.queriers[dir] = querier
+	o.closers = append(o.closers, func() {
+		querier.Close()
+		cleanup()
+	})
+
+	return querier, nil
+}
+
+// Close closes all opened databases.
+func (o *outputQueriers) Close() {
+	for _, closer := range o.closers {
+		closer()
+	}
+}
+
+// openOutput opens the output directory as a TSDB database without running
+// compactions. The returned function closes the database and removes the
+// write-ahead log directory if it was created by opening the database.
+func openOutput(dir string) (*tsdb.DB, func(), error) {
+	walDir := filepath.Join(dir, "wal")
+	_, err := os.Stat(walDir)
+	createdWAL := os.IsNotExist(err)
+
+	db, err := tsdb.Open(dir, nil, nil, &tsdb.Options{
+		// The head is truncated at the end of the newest block, which needs to
+		// be aligned to the chunk range. The blocks are aligned to the step,
+		// which does not need to be a multiple of the default range, so use the
+		// smallest possible range.
+		BlockRanges: []int64{1},
+		NoLockfile:  true,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	db.DisableCompactions()
+
+	return db, func() {
+		if err := db.Close(); err != nil {
+			log.Printf("Error closing output: %s", err)
+		}
+
+		if createdWAL {
+			os.RemoveAll(walDir)
+		}
+	}, nil
+}
+
+// outputSeries returns the series in the output directory with chunks between
+// mint and maxt. The series are read from the block indexes, because the
+// querier can not select series without a common label.
+func outputSeries(dir string, mint, maxt int64) ([]labels.Labels, error) {
+	dirs, err := blockDirs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []labels.Labels
+	seen := make(map[string]bool)
+	for _, d := range dirs {
+		meta, err := readBlockMeta(d)
+		if err != nil {
+			return nil, err
+		}
+		if meta.MaxTime <= mint || meta.MinTime > maxt {
+			continue
+		}
+
+		index, err := tsdb.NewIndexReader(d)
+		if err != nil {
+			return nil, err
+		}
+
+		err = forEachSeries(index, func(lset labels.Labels, chks []tsdb.ChunkMeta) error {
+			if seen[lset.String()] || !overlapsChunks(chks, mint, maxt) {
+				return nil
+			}
+			seen[lset.String()] = true
+			result = append(result, copyLabels(lset))
+			return nil
+		})
+		index.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// copyLabels copies the labels out of the memory-mapped index, which is
+// unmapped when the index is closed.
+func copyLabels(lset labels.Labels) labels.Labels {
+	result := make(labels.Labels, len(lset))
+	for i, l := range lset {
+		result[i] = labels.Label{
+			Name:  string([]byte(l.Name)),
+			Value: string([]byte(l.Value)),
+		}
+	}
+
+	return result
+}
+
+func overlapsChunks(chks []tsdb.ChunkMeta, mint, maxt int64) bool {
+	for _, c := range chks {
+		if c.MinTime <= maxt && c.MaxTime >= mint {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesAny returns true if the labels match any of the matcher sets.
+func matchesAny(lset labels.Labels, matcherSets []metric.LabelMatchers) bool {
+	for _, matchers := range matcherSets {
+		matches := true
+		for _, m := range matchers {
+			if !m.Match(model.LabelValue(lset.Get(string(m.Name)))) {
+				matches = false
+				break
+			}
+		}
+
+		if matches {
+			return true
+		}
+	}
+
+	return false
+}
+
+func inputSamples(ctx context.Context, input inputStorage, m model.Metric, interval metric.Interval) ([]model.SamplePair, error) {
+	iterator, err := querySeries(ctx, input, interval.OldestInclusive, interval.NewestInclusive, m)
+	if err != nil || iterator == nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	samples := iterator.RangeValues(interval)
+	return samples, iteratorErr(iterator)
+}
+
+func outputSamples(querier tsdb.Querier, lset labels.Labels) ([]model.SamplePair, bool, error) {
+	matchers := make([]labels.Matcher, 0, len(lset))
+	for _, l := range lset {
+		matchers = append(matchers, labels.NewEqualMatcher(l.Name, l.Value))
+	}
+
+	set := querier.Select(matchers...)
+	for set.Next() {
+		series := set.At()
+		// Equality matchers can not exclude additional labels.
+		if !series.Labels().Equals(lset) {
+			continue
+		}
+
+		var samples []model.SamplePair
+		it := series.Iterator()
+		for it.Next() {
+			t, v := it.At()
+			// Staleness markers are not part of the input.
+			if isStaleMarker(model.SampleValue(v)) {
+				continue
+			}
+			samples = append(samples, model.SamplePair{
+				Timestamp: model.Time(t),
+				Value:     model.SampleValue(v),
+			})
+		}
+
+		return samples, true, it.Err()
+	}
+
+	return nil, false, set.Err()
+}
+
+// compareSamples returns the number of samples only found in expected, only
+// found in actual and with differing values, together with the time of the
+// first difference.
+func compareSamples(expected, actual []model.SamplePair) (missing, extra, mismatch int, first model.Time) {
+	first = model.Latest
+	diff := func(t model.Time) {
+		if t.Before(first) {
+			first = t
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(expected) && j < len(actual) {
+		e, a := expected[i], actual[j]
+		switch {
+		case e.Timestamp.Before(a.Timestamp):
+			missing++
+			diff(e.Timestamp)
+			i++
+		case a.Timestamp.Before(e.Timestamp):
+			extra++
+			diff(a.Timestamp)
+			j++
+		default:
+			if !sameValue(e.Value, a.Value) {
+				mismatch++
+				diff(e.Timestamp)
+			}
+			i++
+			j++
+		}
+	}
+
+	if i < len(expected) {
+		missing += len(expected) - i
+		diff(expected[i].Timestamp)
+	}
+
+	if j < len(actual) {
+		extra += len(actual) - j
+		diff(actual[j].Timestamp)
+	}
+
+	return missing, extra, mismatch, first
+}
+
+func sameValue(a, b model.SampleValue) bool {
+	if math.IsNaN(float64(a)) || math.IsNaN(float64(b)) {
+		return math.Float64bits(float64(a)) == math.Float64bits(float64(b))
+	}
+
+	return a == b
+}
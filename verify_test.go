@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	cfg "github.com/xperimental/tsdb-migrate/config"
+)
+
+func TestCompareSamples(t *testing.T) {
+	nan := math.NaN()
+	stale := math.Float64frombits(staleNaN)
+
+	for _, test := range []struct {
+		name             string
+		expected, actual []model.SamplePair
+		missing          int
+		extra            int
+		mismatch         int
+		first            model.Time
+	}{
+		{
+			name:     "equal",
+			expected: samples(1, 1, 2, 2),
+			actual:   samples(1, 1, 2, 2),
+			first:    model.Latest,
+		},
+		{
+			name:     "missing sample",
+			expected: samples(1, 1, 2, 2, 3, 3),
+			actual:   samples(1, 1, 3, 3),
+			missing:  1,
+			first:    2,
+		},
+		{
+			name:     "missing samples at the end",
+			expected: samples(1, 1, 2, 2, 3, 3),
+			actual:   samples(1, 1),
+			missing:  2,
+			first:    2,
+		},
+		{
+			name:     "extra sample",
+			expected: samples(1, 1, 3, 3),
+			actual:   samples(1, 1, 2, 2, 3, 3),
+			extra:    1,
+			first:    2,
+		},
+		{
+			name:     "extra samples at the end",
+			expected: samples(1, 1),
+			actual:   samples(1, 1, 2, 2, 3, 3),
+			extra:    2,
+			first:    2,
+		},
+		{
+			name:     "value mismatch",
+			expected: samples(1, 1, 2, 2),
+			actual:   samples(1, 1, 2, 3),
+			mismatch: 1,
+			first:    2,
+		},
+		{
+			name:     "NaN",
+			expected: samples(1, nan),
+			actual:   samples(1, nan),
+			first:    model.Latest,
+		},
+		{
+			name:     "NaN and number",
+			expected: samples(1, nan, 2, 2),
+			actual:   samples(1, 1, 2, nan),
+			mismatch: 2,
+			first:    1,
+		},
+		{
+			// Staleness markers are a different NaN.
+			name:     "stale marker",
+			expected: samples(1, nan),
+			actual:   samples(1, stale),
+			mismatch: 1,
+			first:    1,
+		},
+		{
+			name:     "first difference",
+			expected: samples(1, 1, 2, 2, 4, 4),
+			actual:   samples(0, 0, 2, 3, 4, 4, 5, 5),
+			missing:  1,
+			extra:    2,
+			mismatch: 1,
+			first:    0,
+		},
+	} {
+		missing, extra, mismatch, first := compareSamples(test.expected, test.actual)
+		if missing != test.missing || extra != test.extra || mismatch != test.mismatch || first != test.first {
+			t.Errorf("%s: got %d missing, %d extra, %d mismatched, first at %d, want %d, %d, %d, first at %d",
+				test.name, missing, extra, mismatch, first, test.missing, test.extra, test.mismatch, test.first)
+		}
+	}
+}
+
+// withSamples returns a copy of the series with the samples.
+func withSamples(s *sliceIterator, samples []model.SamplePair) *sliceIterator {
+	return &sliceIterator{metric: s.metric, samples: samples}
+}
+
+// writeSeriesBlocks writes the series unchanged as blocks to dir.
+func writeSeriesBlocks(t *testing.T, dir string, input testInput, width int64) {
+	w, err := newBlockWriter(dir, width, nil, newReport("", dir, cfg.ModeTime, time.Time{}, time.Time{}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range input {
+		if err := w.Append(convertMetric(s.metric), s.samples); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunVerify(t *testing.T) {
+	const minute = model.Time(60000)
+	up := testSeries(model.Metric{model.MetricNameLabel: "up", "job": "a"}, 0, 60*minute, 15000, 0)
+	down := testSeries(model.Metric{model.MetricNameLabel: "down", "job": "a"}, 30*minute, 90*minute, minute, 0)
+	other := testSeries(model.Metric{model.MetricNameLabel: "other"}, 0, 10*minute, minute, 0)
+	input := testInput{up, down}
+
+	nanSamples := append(samples(0, math.NaN()), up.samples[1:]...)
+	staleSamples := append(append([]model.SamplePair{}, up.samples...), marker(61*minute))
+	changed := append([]model.SamplePair{}, up.samples...)
+	changed[10].Value++
+
+	for _, test := range []struct {
+		name   string
+		input  testInput
+		output testInput
+		err    string
+	}{
+		{
+			name:   "identical",
+			input:  input,
+			output: input,
+		},
+		{
+			name:   "missing sample",
+			input:  input,
+			output: testInput{withSamples(up, append(append([]model.SamplePair{}, up.samples[:10]...), up.samples[11:]...)), down},
+			err:    "0 missing series, 0 extra series, 1 missing samples, 0 extra samples, 0 mismatched values",
+		},
+		{
+			name:   "extra sample",
+			input:  testInput{withSamples(up, up.samples[1:]), down},
+			output: input,
+			err:    "0 missing series, 0 extra series, 0 missing samples, 1 extra samples, 0 mismatched values",
+		},
+		{
+			name:   "value mismatch",
+			input:  input,
+			output: testInput{withSamples(up, changed), down},
+			err:    "0 missing series, 0 extra series, 0 missing samples, 0 extra samples, 1 mismatched values",
+		},
+		{
+			name:   "missing series",
+			input:  input,
+			output: testInput{up},
+			err:    "1 missing series, 0 extra series, 60 missing samples",
+		},
+		{
+			name:   "extra series",
+			input:  input,
+			output: testInput{up, down, other},
+			err:    "0 missing series, 1 extra series, 0 missing samples",
+		},
+		{
+			name:   "NaN",
+			input:  testInput{withSamples(up, nanSamples), down},
+			output: testInput{withSamples(up, nanSamples), down},
+		},
+		{
+			// Staleness markers are skipped in the output.
+			name:   "stale marker",
+			input:  input,
+			output: testInput{withSamples(up, staleSamples), down},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "tsdb-migrate")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			writeSeriesBlocks(t, dir, test.output, int64(2*time.Hour/time.Millisecond))
+
+			err = runVerify(context.Background(), test.input, dir, timeFromMillis(0), timeFromMillis(int64(2*60*minute)), []metric.LabelMatchers{{}}, labelRules{}, nil)
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("got error: %s", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
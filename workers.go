@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/common/model"
+)
+
+// shardByFingerprint calls fn for the index of every fingerprint using the
+// given number of goroutines. Every goroutine handles the fingerprints whose
+// value modulo the number of workers equals its number. The first error stops
+// all goroutines before their next fingerprint and is returned.
+func shardByFingerprint(workers int, fps []model.Fingerprint, fn func(i int) error) error {
+	if workers <= 1 {
+		for i := range fps {
+			if err := fn(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var (
+		wg       sync.WaitGroup
+		stopped  int32
+		errOnce  sync.Once
+		firstErr error
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i, fp := range fps {
+				if uint64(fp)%uint64(workers) != uint64(w) {
+					continue
+				}
+
+				if atomic.LoadInt32(&stopped) != 0 {
+					return
+				}
+
+				if err := fn(i); err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						atomic.StoreInt32(&stopped, 1)
+					})
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	return firstErr
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestShardByFingerprint(t *testing.T) {
+	fps := make([]model.Fingerprint, 100)
+	for i := range fps {
+		fps[i] = model.Fingerprint(i)
+	}
+
+	for _, workers := range []int{1, 4} {
+		calls := make([]int32, len(fps))
+		err := shardByFingerprint(workers, fps, func(i int) error {
+			atomic.AddInt32(&calls[i], 1)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%d workers: got error: %s", workers, err)
+		}
+
+		for i, c := range calls {
+			if c != 1 {
+				t.Errorf("%d workers: fingerprint %d handled %d times", workers, i, c)
+			}
+		}
+	}
+}
+
+func TestShardByFingerprintErr(t *testing.T) {
+	fps := make([]model.Fingerprint, 100)
+	for i := range fps {
+		fps[i] = model.Fingerprint(i)
+	}
+
+	errEarly := errors.New("early")
+	errLate := errors.New("late")
+	var calls int32
+	err := shardByFingerprint(4, fps, func(i int) error {
+		atomic.AddInt32(&calls, 1)
+		switch i {
+		case 0:
+			// The first worker fails after the last one.
+			time.Sleep(50 * time.Millisecond)
+			return errLate
+		case 3:
+			return errEarly
+		}
+		time.Sleep(time.Millisecond)
+		return nil
+	})
+	if err != errEarly {
+		t.Errorf("got error %v, want %v", err, errEarly)
+	}
+
+	// The other workers stop before their next fingerprint.
+	if calls >= int32(len(fps)/2) {
+		t.Errorf("got %d calls, want the workers to stop after the error", calls)
+	}
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+const stagingDirName = "migrate-staging"
+
+// blockWriter collects samples in one in-memory head per time window and
+// persists every head as a TSDB block when flushed. Every block covers the
+// whole step containing its window, also at the start and end of the
+// conversion range and if the windows are narrower than the step, so that the
+// blocks stay aligned. The blocks of several windows of a step need to be
+// merged before they can be used. The statistics of the appended samples are
+// only recorded when the blocks are written.
+type blockWriter struct {
+	dir        string
+	step       int64
+	width      int64
+	compactor  *tsdb.LeveledCompactor
+	report     *report
+	deadLetter *deadLetter
+
+	mtx      sync.Mutex
+	heads    map[int64]*tsdb.Head
+	appended []appendedSamples
+	rejected []rejectedSample
+	errors   map[string]int
+}
+
+// appendedSamples records the samples of a series appended to one window.
+type appendedSamples struct {
+	mint    int64
+	lset    labels.Labels
+	samples int
+}
+
+// rejectedSample is a sample which has not been accepted by the head.
+type rejectedSample struct {
+	lset   labels.Labels
+	sample model.SamplePair
+	reason string
+}
+
+func newBlockWriter(dir string, step int64, r prometheus.Registerer, rep *report, dl *deadLetter) (*blockWriter, error) {
+	compactor, err := tsdb.NewLeveledCompactor(r, kitlog.NewNopLogger(), []int64{step}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating compactor: %s", err)
+	}
+
+	return &blockWriter{
+		dir:        dir,
+		step:       step,
+		width:      step,
+		compactor:  compactor,
+		report:     rep,
+		deadLetter: dl,
+		heads:      make(map[int64]*tsdb.Head),
+		errors:     make(map[string]int),
+	}, nil
+}
+
+// SetWidth changes the width of the windows, which needs to divide the step.
+// It can only be called while no samples are collected.
+func (w *blockWriter) SetWidth(width int64) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.width = width
+}
+
+// Append adds the samples of one series. The samples need to be sorted by time.
+// It can be called concurrently for different series.
+func (w *blockWriter) Append(lset labels.Labels, samples []model.SamplePair) error {
+	for len(samples) > 0 {
+		mint := windowStart(int64(samples[0].Timestamp), w.width)
+		maxt := mint + w.width
+
+		end := sort.Search(len(samples), func(i int) bool {
+			return int64(samples[i].Timestamp) >= maxt
+		})
+
+		head, err := w.head(mint)
+		if err != nil {
+			return err
+		}
+
+		appended, err := w.appendSamples(head.Appender(), lset, samples[:end])
+		if err != nil {
+			return err
+		}
+
+		w.mtx.Lock()
+		w.appended = append(w.appended, appendedSamples{mint, lset, appended})
+		w.mtx.Unlock()
+
+		samples = samples[end:]
+	}
+
+	return nil
+}
+
+func (w *blockWriter) head(mint int64) (*tsdb.Head, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	head, ok := w.heads[mint]
+	if ok {
+		return head, nil
+	}
+
+	// The head only accepts samples which are at most half its chunk range
+	// older than the newest sample, so it needs twice the window width.
+	head, err := tsdb.NewHead(nil, nil, nil, 2*w.width)
+	if err != nil {
+		return nil, fmt.Errorf("error creating head: %s", err)
+	}
+	w.heads[mint] = head
+
+	return head, nil
+}
+
+// Flush writes all collected windows as blocks and resets the writer.
+func (w *blockWriter) Flush() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	windows := make([]int64, 0, len(w.heads))
+	for mint := range w.heads {
+		windows = append(windows, mint)
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i] < windows[j] })
+
+	for _, start := range windows {
+		mint := windowStart(start, w.step)
+		head := w.heads[start]
+		if err := w.compactor.Write(w.dir, head, mint, mint+w.step); err != nil {
+			return fmt.Errorf("error writing block: %s", err)
+		}
+
+		series, err := countSeries(head)
+		if err != nil {
+			return fmt.Errorf("error counting series: %s", err)
+		}
+		w.report.AddWindow(start, start+w.width, series)
+	}
+
+	total := 0
+	for _, a := range w.appended {
+		w.report.AddSamples(a.mint, a.lset, a.samples)
+		total += a.samples
+	}
+	samplesAppended.Add(float64(total))
+
+	for reason, count := range w.errors {
+		appendErrors.WithLabelValues(reason).Add(float64(count))
+		w.report.AddAppendErrors(reason, count)
+	}
+
+	if len(w.rejected) > 0 {
+		counts := make(map[string]int)
+		for _, r := range w.rejected {
+			counts[r.reason]++
+
+			if w.deadLetter == nil {
+				continue
+			}
+
+			if err := w.deadLetter.Write(r.lset, r.sample, r.reason); err != nil {
+				return fmt.Errorf("error writing dead-letter file: %s", err)
+			}
+		}
+
+		reasons := make([]string, 0, len(counts))
+		for reason, count := range counts {
+			reasons = append(reasons, fmt.Sprintf("%s=%d", reason, count))
+		}
+		sort.Strings(reasons)
+		log.Printf("Rejected samples: %s", strings.Join(reasons, " "))
+	}
+
+	if w.deadLetter != nil {
+		if err := w.deadLetter.Sync(); err != nil {
+			return fmt.Errorf("error writing dead-letter file: %s", err)
+		}
+	}
+
+	w.reset()
+	return nil
+}
+
+// Discard drops all collected windows without writing them.
+func (w *blockWriter) Discard() {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.reset()
+}
+
+func (w *blockWriter) reset() {
+	w.heads = make(map[int64]*tsdb.Head)
+	w.appended = nil
+	w.rejected = nil
+	w.errors = make(map[string]int)
+}
+
+func (w *blockWriter) appendSamples(appender tsdb.Appender, lset labels.Labels, samples []model.SamplePair) (int, error) {
+	var ref uint64
+	var last model.SamplePair
+	appended := 0
+	for _, sample := range samples {
+		// The head only checks the order of samples against the committed
+		// samples, so the samples of this commit are checked here.
+		var err error
+		switch {
+		case appended == 0 || sample.Timestamp.After(last.Timestamp):
+		case sample.Timestamp.Before(last.Timestamp):
+			err = tsdb.ErrOutOfOrderSample
+		case sameValue(sample.Value, last.Value):
+			// Exact duplicates are ignored like in the head.
+			continue
+		default:
+			err = tsdb.ErrAmendSample
+		}
+
+		if err == nil && ref != 0 {
+			err = appender.AddFast(ref, int64(sample.Timestamp), float64(sample.Value))
+			if errors.Cause(err) == tsdb.ErrNotFound {
+				// The reference is no longer valid, add the sample using the labels.
+				w.appendError(err)
+				ref, err = 0, nil
+			}
+		}
+		if err == nil && ref == 0 {
+			ref, err = appender.Add(lset, int64(sample.Timestamp), float64(sample.Value))
+		}
+
+		switch err {
+		case nil:
+			appended++
+			last = sample
+		case tsdb.ErrOutOfOrderSample, tsdb.ErrAmendSample, tsdb.ErrOutOfBounds:
+			w.reject(lset, sample, err)
+		default:
+			appender.Rollback()
+			return 0, fmt.Errorf("error adding samples: %s", err)
+		}
+	}
+
+	if err := appender.Commit(); err != nil {
+		return 0, fmt.Errorf("error during commit: %s", err)
+	}
+
+	return appended, nil
+}
+
+func (w *blockWriter) appendError(err error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.errors[appendErrorReason(err)]++
+}
+
+// reject counts a sample which was not accepted by the head. It is written to
+// the dead-letter file when the writer is flushed.
+func (w *blockWriter) reject(lset labels.Labels, sample model.SamplePair, err error) {
+	w.appendError(err)
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.rejected = append(w.rejected, rejectedSample{lset, sample, appendErrorReason(err)})
+}
+
+func appendErrorReason(err error) string {
+	switch errors.Cause(err) {
+	case tsdb.ErrOutOfOrderSample:
+		return "out_of_order"
+	case tsdb.ErrAmendSample:
+		return "amend"
+	case tsdb.ErrOutOfBounds:
+		return "out_of_bounds"
+	case tsdb.ErrNotFound:
+		return "not_found"
+	default:
+		return "other"
+	}
+}
+
+// countSeries returns the number of series in the head.
+func countSeries(head *tsdb.Head) (int, error) {
+	index := head.Index()
+	defer index.Close()
+
+	count := 0
+	err := forEachSeries(index, func(labels.Labels, []tsdb.ChunkMeta) error {
+		count++
+		return nil
+	})
+
+	return count, err
+}
+
+// forEachSeries calls fn with the labels and chunks of every series in the
+// index. The arguments are only valid until fn returns.
+func forEachSeries(index tsdb.IndexReader, fn func(lset labels.Labels, chks []tsdb.ChunkMeta) error) error {
+	// The empty label selects all series.
+	postings, err := index.Postings("", "")
+	if err != nil {
+		return fmt.Errorf("error reading postings: %s", err)
+	}
+
+	var lset labels.Labels
+	var chks []tsdb.ChunkMeta
+	for postings.Next() {
+		if err := index.Series(postings.At(), &lset, &chks); err != nil {
+			return fmt.Errorf("error reading series: %s", err)
+		}
+
+		if err := fn(lset, chks); err != nil {
+			return err
+		}
+	}
+
+	if err := postings.Err(); err != nil {
+		return fmt.Errorf("error reading postings: %s", err)
+	}
+	return nil
+}
+
+func windowStart(t, width int64) int64 {
+	if t < 0 {
+		return (t - width + 1) / width * width
+	}
+	return t / width * width
+}
+
+// alignRange returns the range covered by the windows of width which contain
+// the samples from mint up to, but not including, maxt.
+func alignRange(mint, maxt, width int64) (int64, int64) {
+	return windowStart(mint, width), windowStart(maxt-1, width) + width
+}
+
+func timeFromMillis(t int64) time.Time {
+	return time.Unix(0, t*int64(time.Millisecond)).UTC()
+}
+
+type blockMeta struct {
+	Version int `json:"version"`
+
+	*tsdb.BlockMeta
+}
+
+func readBlockMeta(dir string) (*tsdb.BlockMeta, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "meta.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var meta blockMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, err
+	}
+
+	if meta.Version != 1 {
+		return nil, fmt.Errorf("unexpected meta file version %d", meta.Version)
+	}
+
+	return meta.BlockMeta, nil
+}
+
+// blockDirs returns the directories in dir which contain a block.
+func blockDirs(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	for _, fi := range files {
+		if !fi.IsDir() {
+			continue
+		}
+
+		if _, err := ulid.Parse(fi.Name()); err != nil {
+			continue
+		}
+
+		dirs = append(dirs, filepath.Join(dir, fi.Name()))
+	}
+
+	return dirs, nil
+}
+
+// checkOverlap returns an error if a block in dir overlaps the time range.
+func checkOverlap(dir string, mint, maxt int64) error {
+	dirs, err := blockDirs(dir)
+	if err != nil {
+		return fmt.Errorf("error listing blocks: %s", err)
+	}
+
+	for _, dir := range dirs {
+		meta, err := readBlockMeta(dir)
+		if err != nil {
+			return fmt.Errorf("error reading meta of %s: %s", dir, err)
+		}
+
+		if meta.MinTime < maxt && mint < meta.MaxTime {
+			return fmt.Errorf("existing block %s (%s - %s) overlaps conversion range", meta.ULID, timeFromMillis(meta.MinTime), timeFromMillis(meta.MaxTime))
+		}
+	}
+
+	return nil
+}
+
+// mergeStaging combines the blocks in the staging directory which cover the
+// same time window and moves the results to the output directory.
+func mergeStaging(staging, output string, width int64) error {
+	dirs, err := blockDirs(staging)
+	if err != nil {
+		return fmt.Errorf("error listing staged blocks: %s", err)
+	}
+
+	windows := make(map[int64][]string)
+	for _, dir := range dirs {
+		meta, err := readBlockMeta(dir)
+		if err != nil {
+			return fmt.Errorf("error reading meta of %s: %s", dir, err)
+		}
+
+		windows[meta.MinTime] = append(windows[meta.MinTime], dir)
+	}
+
+	compactor, err := tsdb.NewLeveledCompactor(nil, kitlog.NewNopLogger(), []int64{width}, nil)
+	if err != nil {
+		return fmt.Errorf("error creating compactor: %s", err)
+	}
+
+	for mint, dirs := range windows {
+		if len(dirs) == 1 {
+			if err := os.Rename(dirs[0], filepath.Join(output, filepath.Base(dirs[0]))); err != nil {
+				return fmt.Errorf("error moving block: %s", err)
+			}
+			continue
+		}
+
+		log.Printf("Merging %d blocks for %s", len(dirs), timeFromMillis(mint))
+		if err := compactor.Compact(output, dirs...); err != nil {
+			return fmt.Errorf("error merging blocks: %s", err)
+		}
+
+		for _, dir := range dirs {
+			if err := os.RemoveAll(dir); err != nil {
+				return fmt.Errorf("error removing staged block: %s", err)
+			}
+		}
+	}
+
+	return os.Remove(staging)
+}
+
+// mergeOutputs merges the staged blocks of every output directory below root.
+func mergeOutputs(root string, split bool, width int64) error {
+	outputs, err := outputDirs(root, split)
+	if err != nil {
+		return fmt.Errorf("error listing outputs: %s", err)
+	}
+
+	for _, output := range outputs {
+		staging := filepath.Join(output, stagingDirName)
+		if _, err := os.Stat(staging); os.IsNotExist(err) {
+			continue
+		}
+
+		if err := mergeStaging(staging, output, width); err != nil {
+			return fmt.Errorf("error merging blocks: %s", err)
+		}
+	}
+
+	return nil
+}
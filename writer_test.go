@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// staleRefAppender rejects every reference, like a head which has been
+// truncated since the reference was returned.
+type staleRefAppender struct {
+	added     []int64
+	committed bool
+}
+
+func (a *staleRefAppender) Add(l labels.Labels, t int64, v float64) (uint64, error) {
+	a.added = append(a.added, t)
+	return uint64(len(a.added)), nil
+}
+
+func (a *staleRefAppender) AddFast(ref uint64, t int64, v float64) error {
+	return errors.Wrapf(tsdb.ErrNotFound, "unknown series %d", ref)
+}
+
+func (a *staleRefAppender) Commit() error {
+	a.committed = true
+	return nil
+}
+
+func (a *staleRefAppender) Rollback() error {
+	return nil
+}
+
+func TestAppendSamplesStaleRef(t *testing.T) {
+	w, err := newBlockWriter(t.Name(), 1000, nil, newReport("", "", "", timeFromMillis(0), timeFromMillis(1000)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appender := &staleRefAppender{}
+	samples := []model.SamplePair{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}, {Timestamp: 3, Value: 3}}
+	appended, err := w.appendSamples(appender, labels.FromStrings("__name__", "up"), samples)
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+
+	if appended != len(samples) || len(appender.added) != len(samples) || !appender.committed {
+		t.Errorf("appended %d samples, %d by labels, committed %t, want %d", appended, len(appender.added), appender.committed, len(samples))
+	}
+
+	if got := w.errors["not_found"]; got != 2 {
+		t.Errorf("got %d not_found errors, want 2", got)
+	}
+}